@@ -0,0 +1,33 @@
+package main
+
+type aggregateEntry struct {
+	seq   uint64
+	value any
+}
+
+// Aggregate returns the result of compute over all users, cached under key
+// until the next db write of any id. compute runs with the db locked, must
+// not keep or modify users, and should return the same kind of value for the
+// same key. Buffered writes under WriteCoalesceWindow count once flushed. With
+// CacheOnly there is no db; compute sees the cached users and nothing is kept.
+// On a repo that is not initialized compute is not called and nil is returned.
+func (u *UserRepo) Aggregate(key string, compute func(users map[int]User) any) any {
+	if !u.ready.Load() {
+		return nil
+	}
+	if u.cfg.CacheOnly {
+		return compute(u.backend().snapshot())
+	}
+
+	u.dbMutex.Lock()
+	defer u.dbMutex.Unlock()
+	// every db write bumps seq, so an entry computed at the current seq is
+	// still valid
+	if e, ok := u.aggregates[key]; ok && e.seq == u.seq {
+		return e.value
+	}
+	v := compute(u.db)
+	u.aggregates[key] = aggregateEntry{seq: u.seq, value: v}
+
+	return v
+}
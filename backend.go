@@ -0,0 +1,536 @@
+package main
+
+import (
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type CacheKind int
+
+const (
+	CacheRWMutex CacheKind = iota
+	CacheSyncMap
+	CacheCOW
+	CacheSnapshot
+	CacheMutex
+)
+
+// cacheKinds lists every backend, in the order main reports them.
+var cacheKinds = []CacheKind{CacheSyncMap, CacheRWMutex, CacheMutex, CacheCOW, CacheSnapshot}
+
+// strictKinds lists the backends whose reads always see the latest write;
+// CacheSnapshot is left out as its reads may be a publish interval stale.
+var strictKinds = []CacheKind{CacheSyncMap, CacheRWMutex, CacheMutex, CacheCOW}
+
+func (k CacheKind) String() string {
+	switch k {
+	case CacheRWMutex:
+		return "RWMutex"
+	case CacheSyncMap:
+		return "sync.Map"
+	case CacheCOW:
+		return "COW pointer"
+	case CacheSnapshot:
+		return "snapshot"
+	case CacheMutex:
+		return "Mutex"
+	}
+	return "unknown"
+}
+
+type cacheBackend interface {
+	load(id int) (User, bool)
+	swap(id int, user User) (User, bool)
+	delete(id int)
+	loadAndDelete(id int) (User, bool)
+	compareAndDelete(id int, old User) bool
+	keys() []int
+	snapshot() map[int]User
+	len() int
+}
+
+// backendCloser is implemented by backends that run a goroutine.
+type backendCloser interface {
+	close()
+}
+
+// backendResizer is implemented by backends with an entry bound.
+type backendResizer interface {
+	resize(max int)
+	limit() int
+}
+
+type cacheRef struct {
+	cacheBackend
+}
+
+// newCacheBackend builds the backend for cfg.Kind. onEvict is called for
+// every entry a backend drops on its own to stay within its bounds; only the
+// sync.Map backend takes the MaxEntries bound, which validate makes sure of.
+func newCacheBackend(cfg CacheConfig, pins *pinSet, onEvict func(id int)) cacheBackend {
+	switch cfg.Kind {
+	case CacheSyncMap:
+		c := &syncMapCache{pins: pins, onEvict: onEvict}
+		if cfg.Overflow == OverflowEvict {
+			c.max.Store(int64(cfg.MaxEntries))
+		}
+		return c
+	case CacheCOW:
+		return &cowCache{m: make(map[int]*User)}
+	case CacheSnapshot:
+		interval := cfg.PublishInterval
+		if interval == 0 {
+			interval = defaultPublishInterval
+		}
+		return newSnapshotCache(interval)
+	case CacheMutex:
+		return &mutexCache{m: make(map[int]User)}
+	}
+	return &rwMutexCache{rwm: newRWLocker(cfg.LockPreference), m: make(map[int]User)}
+}
+
+// syncMapCache optionally bounds itself to max entries. sync.Map has no cheap
+// length, so count is an approximation kept by counting new keys on store and
+// removed keys on delete; once it passes a non-zero max, one goroutine at a
+// time runs an eviction pass over Range that drops arbitrary entries down to
+// 90% of max, skipping pinned ids and the id whose store started the pass.
+// The cache can briefly hold more than max entries while that pass runs.
+type syncMapCache struct {
+	m        sync.Map
+	max      atomic.Int64
+	count    atomic.Int64
+	evicting atomic.Bool
+	pins     *pinSet
+	onEvict  func(id int)
+}
+
+func (c *syncMapCache) load(id int) (User, bool) {
+	user, ok := c.m.Load(id)
+	if !ok {
+		return User{}, false
+	}
+	return user.(User), true
+}
+
+func (c *syncMapCache) swap(id int, user User) (User, bool) {
+	old, loaded := c.m.Swap(id, user)
+	if loaded {
+		return old.(User), true
+	}
+	if max := c.max.Load(); c.count.Add(1) > max && max > 0 {
+		c.evict(id)
+	}
+	return User{}, false
+}
+
+func (c *syncMapCache) delete(id int) {
+	if _, loaded := c.m.LoadAndDelete(id); loaded {
+		c.count.Add(-1)
+	}
+}
+
+func (c *syncMapCache) loadAndDelete(id int) (User, bool) {
+	user, loaded := c.m.LoadAndDelete(id)
+	if !loaded {
+		return User{}, false
+	}
+	c.count.Add(-1)
+	return user.(User), true
+}
+
+func (c *syncMapCache) compareAndDelete(id int, old User) bool {
+	if c.m.CompareAndDelete(id, old) {
+		c.count.Add(-1)
+		return true
+	}
+	return false
+}
+
+func (c *syncMapCache) snapshot() map[int]User {
+	m := make(map[int]User)
+	c.m.Range(func(k, v any) bool {
+		m[k.(int)] = v.(User)
+		return true
+	})
+	return m
+}
+
+func (c *syncMapCache) len() int {
+	return int(c.count.Load())
+}
+
+func (c *syncMapCache) evict(keep int) {
+	if !c.evicting.CompareAndSwap(false, true) {
+		return
+	}
+	defer c.evicting.Store(false)
+
+	max := c.max.Load()
+	target := max - max/10
+	c.m.Range(func(k, _ any) bool {
+		if c.count.Load() <= target {
+			return false
+		}
+		if id := k.(int); id != keep && !c.pins.has(id) {
+			c.delete(id)
+			c.onEvict(id)
+		}
+		return true
+	})
+}
+
+func (c *syncMapCache) limit() int {
+	return int(c.max.Load())
+}
+
+// resize changes the bound without evicting; UserRepo.Resize shrinks the
+// cache to it first. Zero removes the bound.
+func (c *syncMapCache) resize(max int) {
+	c.max.Store(int64(max))
+}
+
+func (c *syncMapCache) keys() []int {
+	keys := make([]int, 0)
+	c.m.Range(func(k, _ any) bool {
+		keys = append(keys, k.(int))
+		return true
+	})
+	return keys
+}
+
+type rwMutexCache struct {
+	rwm rwLocker
+	m   map[int]User
+}
+
+func (c *rwMutexCache) load(id int) (User, bool) {
+	c.rwm.RLock()
+	user, ok := c.m[id]
+	c.rwm.RUnlock()
+	return user, ok
+}
+
+func (c *rwMutexCache) swap(id int, user User) (User, bool) {
+	c.rwm.Lock()
+	old, ok := c.m[id]
+	c.m[id] = user
+	c.rwm.Unlock()
+	return old, ok
+}
+
+func (c *rwMutexCache) delete(id int) {
+	c.rwm.Lock()
+	delete(c.m, id)
+	c.rwm.Unlock()
+}
+
+func (c *rwMutexCache) loadAndDelete(id int) (User, bool) {
+	c.rwm.Lock()
+	defer c.rwm.Unlock()
+	user, ok := c.m[id]
+	delete(c.m, id)
+	return user, ok
+}
+
+func (c *rwMutexCache) compareAndDelete(id int, old User) bool {
+	c.rwm.Lock()
+	defer c.rwm.Unlock()
+	if user, ok := c.m[id]; !ok || user != old {
+		return false
+	}
+	delete(c.m, id)
+	return true
+}
+
+func (c *rwMutexCache) snapshot() map[int]User {
+	c.rwm.RLock()
+	defer c.rwm.RUnlock()
+	return maps.Clone(c.m)
+}
+
+func (c *rwMutexCache) len() int {
+	c.rwm.RLock()
+	defer c.rwm.RUnlock()
+	return len(c.m)
+}
+
+func (c *rwMutexCache) keys() []int {
+	c.rwm.RLock()
+	keys := make([]int, 0, len(c.m))
+	for id := range c.m {
+		keys = append(keys, id)
+	}
+	c.rwm.RUnlock()
+	return keys
+}
+
+// mutexCache is rwMutexCache with an exclusive lock: reads serialize too, but
+// each lock and unlock is cheaper, which pays off when writes dominate.
+type mutexCache struct {
+	mu sync.Mutex
+	m  map[int]User
+}
+
+func (c *mutexCache) load(id int) (User, bool) {
+	c.mu.Lock()
+	user, ok := c.m[id]
+	c.mu.Unlock()
+	return user, ok
+}
+
+func (c *mutexCache) swap(id int, user User) (User, bool) {
+	c.mu.Lock()
+	old, ok := c.m[id]
+	c.m[id] = user
+	c.mu.Unlock()
+	return old, ok
+}
+
+func (c *mutexCache) delete(id int) {
+	c.mu.Lock()
+	delete(c.m, id)
+	c.mu.Unlock()
+}
+
+func (c *mutexCache) loadAndDelete(id int) (User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	user, ok := c.m[id]
+	delete(c.m, id)
+	return user, ok
+}
+
+func (c *mutexCache) compareAndDelete(id int, old User) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if user, ok := c.m[id]; !ok || user != old {
+		return false
+	}
+	delete(c.m, id)
+	return true
+}
+
+func (c *mutexCache) snapshot() map[int]User {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return maps.Clone(c.m)
+}
+
+func (c *mutexCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.m)
+}
+
+func (c *mutexCache) keys() []int {
+	c.mu.Lock()
+	keys := make([]int, 0, len(c.m))
+	for id := range c.m {
+		keys = append(keys, id)
+	}
+	c.mu.Unlock()
+	return keys
+}
+
+// cowCache holds shared immutable *User values. A store always installs a new
+// pointer and never writes through an old one, so a reader that loaded a
+// pointer keeps seeing a consistent value without copying under the lock.
+type cowCache struct {
+	rwm sync.RWMutex
+	m   map[int]*User
+}
+
+func (c *cowCache) load(id int) (User, bool) {
+	c.rwm.RLock()
+	p := c.m[id]
+	c.rwm.RUnlock()
+	if p == nil {
+		return User{}, false
+	}
+	return *p, true
+}
+
+func (c *cowCache) swap(id int, user User) (User, bool) {
+	p := &user
+	c.rwm.Lock()
+	old := c.m[id]
+	c.m[id] = p
+	c.rwm.Unlock()
+	if old == nil {
+		return User{}, false
+	}
+	return *old, true
+}
+
+func (c *cowCache) delete(id int) {
+	c.rwm.Lock()
+	delete(c.m, id)
+	c.rwm.Unlock()
+}
+
+func (c *cowCache) loadAndDelete(id int) (User, bool) {
+	c.rwm.Lock()
+	defer c.rwm.Unlock()
+	p := c.m[id]
+	if p == nil {
+		return User{}, false
+	}
+	delete(c.m, id)
+	return *p, true
+}
+
+func (c *cowCache) compareAndDelete(id int, old User) bool {
+	c.rwm.Lock()
+	defer c.rwm.Unlock()
+	if p := c.m[id]; p == nil || *p != old {
+		return false
+	}
+	delete(c.m, id)
+	return true
+}
+
+func (c *cowCache) snapshot() map[int]User {
+	c.rwm.RLock()
+	defer c.rwm.RUnlock()
+	m := make(map[int]User, len(c.m))
+	for id, p := range c.m {
+		m[id] = *p
+	}
+	return m
+}
+
+func (c *cowCache) len() int {
+	c.rwm.RLock()
+	defer c.rwm.RUnlock()
+	return len(c.m)
+}
+
+func (c *cowCache) keys() []int {
+	c.rwm.RLock()
+	keys := make([]int, 0, len(c.m))
+	for id := range c.m {
+		keys = append(keys, id)
+	}
+	c.rwm.RUnlock()
+	return keys
+}
+
+// snapshotCache serves reads lock-free from an immutable map that is
+// republished from the mutex-guarded write map every interval while there are
+// unpublished writes. A read can therefore miss or see an older value for up
+// to one interval (plus the time to copy the map) after a write; keys and len
+// reflect the write map and are always current.
+type snapshotCache struct {
+	mu    sync.Mutex
+	m     map[int]User
+	dirty bool
+	snap  atomic.Pointer[map[int]User]
+	stop  chan struct{}
+	once  sync.Once
+}
+
+func newSnapshotCache(interval time.Duration) *snapshotCache {
+	c := &snapshotCache{m: make(map[int]User), stop: make(chan struct{})}
+	c.snap.Store(&map[int]User{})
+	go c.run(interval)
+	return c
+}
+
+func (c *snapshotCache) run(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-t.C:
+			c.publish()
+		}
+	}
+}
+
+func (c *snapshotCache) publish() {
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return
+	}
+	m := maps.Clone(c.m)
+	c.dirty = false
+	c.mu.Unlock()
+
+	c.snap.Store(&m)
+}
+
+func (c *snapshotCache) close() {
+	c.once.Do(func() {
+		close(c.stop)
+	})
+}
+
+func (c *snapshotCache) load(id int) (User, bool) {
+	user, ok := (*c.snap.Load())[id]
+	return user, ok
+}
+
+func (c *snapshotCache) swap(id int, user User) (User, bool) {
+	c.mu.Lock()
+	old, ok := c.m[id]
+	c.m[id] = user
+	c.dirty = true
+	c.mu.Unlock()
+	return old, ok
+}
+
+func (c *snapshotCache) delete(id int) {
+	c.mu.Lock()
+	delete(c.m, id)
+	c.dirty = true
+	c.mu.Unlock()
+}
+
+func (c *snapshotCache) loadAndDelete(id int) (User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	user, ok := c.m[id]
+	if ok {
+		delete(c.m, id)
+		c.dirty = true
+	}
+	return user, ok
+}
+
+func (c *snapshotCache) compareAndDelete(id int, old User) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if user, ok := c.m[id]; !ok || user != old {
+		return false
+	}
+	delete(c.m, id)
+	c.dirty = true
+	return true
+}
+
+func (c *snapshotCache) snapshot() map[int]User {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return maps.Clone(c.m)
+}
+
+func (c *snapshotCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.m)
+}
+
+func (c *snapshotCache) keys() []int {
+	c.mu.Lock()
+	keys := make([]int, 0, len(c.m))
+	for id := range c.m {
+		keys = append(keys, id)
+	}
+	c.mu.Unlock()
+	return keys
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type pendingWrite struct {
+	user User
+	cost int64
+}
+
+// writeCoalescer holds the latest buffered Store per id. mu is held for the
+// whole flush of an id, and by Swap and Increment, so a buffered value can
+// never be written after a newer direct write of the same id.
+type writeCoalescer struct {
+	mu      sync.Mutex
+	pending map[int]pendingWrite
+}
+
+func (c *writeCoalescer) get(id int) (User, bool) {
+	c.mu.Lock()
+	w, ok := c.pending[id]
+	c.mu.Unlock()
+	return w.user, ok
+}
+
+// coalesce buffers the write and, if none was buffered for id yet, schedules
+// a flush after the window. The flush waits out the window on an async pool
+// slot; with no slot free it is written at once instead. A scheduled flush
+// counts as an in-flight write so Drain waits for it.
+func (u *UserRepo) coalesce(id int, user User, cost int64) {
+	c := &u.coalescer
+	c.mu.Lock()
+	_, queued := c.pending[id]
+	c.pending[id] = pendingWrite{user: user, cost: cost}
+	c.mu.Unlock()
+
+	if !queued {
+		u.writes.Add(1)
+		flush := func() {
+			time.Sleep(u.cfg.WriteCoalesceWindow)
+			u.flushPending(id)
+		}
+		if !u.spawn(flush) {
+			u.flushPending(id)
+		}
+	}
+}
+
+func (u *UserRepo) flushPending(id int) {
+	defer u.writes.Add(-1)
+
+	c := &u.coalescer
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w, ok := c.pending[id]
+	if !ok {
+		return
+	}
+	u.write(id, w.user, w.cost)
+	delete(c.pending, id)
+}
@@ -0,0 +1,104 @@
+package main
+
+import "sync"
+
+type costEntry struct {
+	cost int64
+	tick uint64
+}
+
+// costTracker keeps the cache under a total cost budget. Each entry carries a
+// caller-supplied cost and the tick of its last store or hit; when the budget
+// is exceeded the entry with the lowest cost per tick of age is evicted first,
+// so expensive entries outlive cheap ones of the same age. Pinned entries are
+// never chosen. Eviction scans all tracked entries, which is fine for the
+// cache sizes used here.
+type costTracker struct {
+	mu      sync.Mutex
+	max     int64
+	total   int64
+	tick    uint64
+	entries map[int]costEntry
+	pins    *pinSet
+}
+
+func (c *costTracker) init(max int64, pins *pinSet) {
+	c.max = max
+	c.pins = pins
+	c.entries = make(map[int]costEntry)
+}
+
+// put records a store of id. A cost <= 0 keeps the entry's current cost, or
+// uses 1 for an untracked entry. evict is called under the tracker lock for
+// every entry dropped to get back under budget.
+func (c *costTracker) put(id int, cost int64, evict func(id int)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tick++
+	e, ok := c.entries[id]
+	if cost <= 0 {
+		cost = 1
+		if ok {
+			cost = e.cost
+		}
+	}
+	c.total += cost - e.cost
+	c.entries[id] = costEntry{cost: cost, tick: c.tick}
+
+	for c.total > c.max {
+		victim, ok := c.cheapest()
+		if !ok {
+			return
+		}
+		c.total -= c.entries[victim].cost
+		delete(c.entries, victim)
+		evict(victim)
+	}
+}
+
+func (c *costTracker) cheapest() (int, bool) {
+	victim, score, found := 0, 0.0, false
+	for id, e := range c.entries {
+		if c.pins.has(id) {
+			continue
+		}
+		s := float64(e.cost) / float64(c.tick-e.tick+1)
+		if !found || s < score {
+			victim, score, found = id, s, true
+		}
+	}
+	return victim, found
+}
+
+func (c *costTracker) touch(id int) {
+	c.mu.Lock()
+	if e, ok := c.entries[id]; ok {
+		c.tick++
+		e.tick = c.tick
+		c.entries[id] = e
+	}
+	c.mu.Unlock()
+}
+
+func (c *costTracker) remove(id int) {
+	c.mu.Lock()
+	if e, ok := c.entries[id]; ok {
+		c.total -= e.cost
+		delete(c.entries, id)
+	}
+	c.mu.Unlock()
+}
+
+func (c *costTracker) reset() {
+	c.mu.Lock()
+	c.total = 0
+	c.entries = make(map[int]costEntry)
+	c.mu.Unlock()
+}
+
+func (c *costTracker) cost() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.total
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// LoadUsersCSV reads "id,name" rows from r into the db, and into the cache as
+// well when warm is set or the repo is CacheOnly; otherwise cached entries
+// for the loaded ids are dropped. Nothing is stored if any row is malformed;
+// the error names the offending line.
+func (u *UserRepo) LoadUsersCSV(r io.Reader, warm bool) error {
+	u.writes.Add(1)
+	defer u.writes.Add(-1)
+	if u.draining.Load() {
+		return ErrDraining
+	}
+	if !u.ready.Load() {
+		return ErrNotInitialized
+	}
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 2
+	cr.TrimLeadingSpace = true
+
+	users := make(map[int]User)
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		var perr *csv.ParseError
+		if errors.As(err, &perr) {
+			return fmt.Errorf("line %d: %w", perr.Line, perr.Err)
+		}
+		if err != nil {
+			return err
+		}
+
+		line, _ := cr.FieldPos(0)
+		id, err := strconv.Atoi(rec[0])
+		if err != nil {
+			return fmt.Errorf("line %d: bad id %q", line, rec[0])
+		}
+		users[id] = User{Name: rec[1]}
+	}
+
+	if warm || u.cfg.CacheOnly {
+		return u.Seed(users)
+	}
+
+	u.dbMutex.Lock()
+	for id, user := range users {
+		u.putDB(id, user)
+		u.bumpVersion(id)
+	}
+	u.dbMutex.Unlock()
+	for id, user := range users {
+		u.removeFromCache(id)
+		u.mirror(id, user)
+	}
+
+	return nil
+}
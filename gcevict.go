@@ -0,0 +1,51 @@
+package main
+
+import "runtime"
+
+type gcSentinel struct {
+	_ [64]byte
+}
+
+// armGCSentinel allocates an unreachable object whose cleanup runs after the
+// next GC cycle. The cleanup wakes shedOnGC and arms the next sentinel, so the
+// repo hears about every cycle until Close.
+func (u *UserRepo) armGCSentinel() {
+	runtime.AddCleanup(new(gcSentinel), func(u *UserRepo) {
+		select {
+		case <-u.done:
+			return
+		default:
+		}
+		select {
+		case u.gcCycles <- struct{}{}:
+		default:
+		}
+		u.armGCSentinel()
+	}, u)
+}
+
+// shedOnGC drops EvictOnGC of the unpinned cached entries after each GC cycle.
+// Each pass takes a Keys snapshot, so it is O(n) in the cache size.
+func (u *UserRepo) shedOnGC() {
+	defer u.bg.Done()
+	for {
+		select {
+		case <-u.done:
+			return
+		case <-u.gcCycles:
+			keys := u.Keys()
+			n := int(float64(len(keys)) * u.cfg.EvictOnGC)
+			for _, id := range keys {
+				if n == 0 {
+					break
+				}
+				if u.pins.has(id) {
+					continue
+				}
+				u.removeFromCache(id)
+				u.stats.gcEvicted.Add(1)
+				n--
+			}
+		}
+	}
+}
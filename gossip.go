@@ -0,0 +1,92 @@
+package main
+
+import "cmp"
+
+type entryVersion struct {
+	version uint64
+	seq     uint64
+}
+
+type gossipMsg struct {
+	id      int
+	user    User
+	version uint64
+}
+
+// bumpVersion must be called with dbMutex held.
+func (u *UserRepo) bumpVersion(id int) {
+	u.seq++
+	u.versions[id] = entryVersion{version: u.versions[id].version + 1, seq: u.seq}
+}
+
+// Gossip runs one push round from u to peer: every write u has seen since the
+// previous round to the same peer is sent over a channel and applied on peer
+// with last-writer-wins by version. Call it in both directions to exchange.
+// A draining peer takes no writes; a CacheOnly peer keeps no versions and
+// caches every write it is sent.
+func (u *UserRepo) Gossip(peer *UserRepo) {
+	if !u.ready.Load() || !peer.ready.Load() || peer.draining.Load() {
+		return
+	}
+	ch := make(chan gossipMsg)
+	go func() {
+		defer close(ch)
+		u.dbMutex.Lock()
+		mark := u.peerMarks[peer]
+		msgs := make([]gossipMsg, 0)
+		for id, v := range u.versions {
+			if v.seq > mark {
+				msgs = append(msgs, gossipMsg{id, u.db[id], v.version})
+			}
+		}
+		u.peerMarks[peer] = u.seq
+		u.dbMutex.Unlock()
+
+		for _, m := range msgs {
+			ch <- m
+		}
+	}()
+
+	for m := range ch {
+		peer.applyGossip(m)
+	}
+}
+
+// applyGossip writes m through the same path as Store, unless peer is
+// draining or already has a newer write of the id. An applied write replaces
+// a Store of the id still buffered by WriteCoalesceWindow.
+func (u *UserRepo) applyGossip(m gossipMsg) {
+	u.writes.Add(1)
+	defer u.writes.Add(-1)
+	if u.draining.Load() {
+		return
+	}
+	if u.cfg.WriteCoalesceWindow > 0 {
+		u.coalescer.mu.Lock()
+		defer u.coalescer.mu.Unlock()
+	}
+
+	_, _, applied := u.writeIf(m.id, m.user, 1, func() bool {
+		cur, ok := u.versions[m.id]
+		// equal versions written on different nodes are broken by comparing
+		// the users so that both sides settle on the same value
+		if ok && (m.version < cur.version || m.version == cur.version && m.user.compare(u.db[m.id]) <= 0) {
+			return false
+		}
+		u.seq++
+		u.versions[m.id] = entryVersion{version: m.version, seq: u.seq}
+		return true
+	})
+	if !applied {
+		return
+	}
+	if u.cfg.WriteCoalesceWindow > 0 {
+		delete(u.coalescer.pending, m.id)
+	}
+	u.logFor(m.id).Println(gossipApplied)
+}
+
+// compare orders users by Name, then Counter.
+func (u User) compare(o User) int {
+	return cmp.Or(cmp.Compare(u.Name, o.Name), cmp.Compare(u.Counter, o.Counter))
+}
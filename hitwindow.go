@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	hitBucketWidth = 10 * time.Second
+	// hitBuckets covers the longest reported window, 5 minutes.
+	hitBuckets = 30
+)
+
+// WindowCounts are the cache hits and misses seen within a recent window.
+type WindowCounts struct {
+	Hits   uint64
+	Misses uint64
+}
+
+func (w WindowCounts) HitRatio() float64 {
+	if w.Hits+w.Misses == 0 {
+		return 0
+	}
+	return float64(w.Hits) / float64(w.Hits+w.Misses)
+}
+
+type hitBucket struct {
+	epoch  atomic.Int64
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// hitWindow is a ring of hitBucketWidth buckets indexed by time. The first
+// lookup in a new period takes over the bucket last used hitBuckets periods
+// ago and clears it; lookups racing with that clear may be lost, which is
+// fine for a ratio.
+type hitWindow struct {
+	buckets [hitBuckets]hitBucket
+}
+
+func (w *hitWindow) record(now time.Time, hit bool) {
+	e := now.UnixNano() / int64(hitBucketWidth)
+	b := &w.buckets[e%hitBuckets]
+	if old := b.epoch.Load(); old != e && b.epoch.CompareAndSwap(old, e) {
+		b.hits.Store(0)
+		b.misses.Store(0)
+	}
+	if hit {
+		b.hits.Add(1)
+	} else {
+		b.misses.Add(1)
+	}
+}
+
+func (w *hitWindow) reset() {
+	for i := range w.buckets {
+		b := &w.buckets[i]
+		b.hits.Store(0)
+		b.misses.Store(0)
+	}
+}
+
+// counts sums the buckets of the last span, including the current one.
+func (w *hitWindow) counts(now time.Time, span time.Duration) WindowCounts {
+	e := now.UnixNano() / int64(hitBucketWidth)
+	var c WindowCounts
+	for i := int64(0); i < int64(span/hitBucketWidth); i++ {
+		b := &w.buckets[(e-i)%hitBuckets]
+		if b.epoch.Load() == e-i {
+			c.Hits += b.hits.Load()
+			c.Misses += b.misses.Load()
+		}
+	}
+	return c
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"cmp"
+	"container/heap"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+type KeyStat struct {
+	ID   int
+	Hits uint64
+}
+
+// hitCounter counts cache hits per cached id. A hit costs one map load and an
+// atomic add; the counter of an entry is dropped with the entry.
+type hitCounter struct {
+	hits sync.Map
+}
+
+func (c *hitCounter) hit(id int) {
+	v, ok := c.hits.Load(id)
+	if !ok {
+		v, _ = c.hits.LoadOrStore(id, &atomic.Uint64{})
+	}
+	v.(*atomic.Uint64).Add(1)
+}
+
+func (c *hitCounter) forget(id int) {
+	c.hits.Delete(id)
+}
+
+// keyHeap is a min-heap by hits, holding the current top n.
+type keyHeap []KeyStat
+
+func (h keyHeap) Len() int           { return len(h) }
+func (h keyHeap) Less(i, j int) bool { return h[i].Hits < h[j].Hits }
+func (h keyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *keyHeap) Push(x any)        { *h = append(*h, x.(KeyStat)) }
+func (h *keyHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// top returns the n ids with the most hits, most hit first. Counters are read
+// while hits go on, so the result is approximate under load.
+func (c *hitCounter) top(n int) []KeyStat {
+	if n <= 0 {
+		return nil
+	}
+	h := make(keyHeap, 0, n)
+	c.hits.Range(func(k, v any) bool {
+		s := KeyStat{ID: k.(int), Hits: v.(*atomic.Uint64).Load()}
+		if h.Len() < n {
+			heap.Push(&h, s)
+		} else if s.Hits > h[0].Hits {
+			h[0] = s
+			heap.Fix(&h, 0)
+		}
+		return true
+	})
+
+	slices.SortFunc(h, func(a, b KeyStat) int {
+		return cmp.Compare(b.Hits, a.Hits)
+	})
+	return h
+}
+
+// TopKeys returns the n cached ids with the most cache hits, most hit first.
+// It needs TrackHotKeys and otherwise returns nil. It scans every counter
+// with an n-sized heap, so it is O(entries * log n).
+func (u *UserRepo) TopKeys(n int) []KeyStat {
+	if !u.cfg.TrackHotKeys {
+		return nil
+	}
+	return u.hotKeys.top(n)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+const inflightShards = 16
+
+type inflightCall struct {
+	done chan struct{}
+	user User
+	ok   bool
+}
+
+type inflightShard struct {
+	mu sync.Mutex
+	m  map[int]*inflightCall
+}
+
+// inflightGroup coalesces concurrent loads of the same id. It is sharded by id
+// so that tracking distinct cold loads does not serialize on a single mutex.
+type inflightGroup struct {
+	shards [inflightShards]inflightShard
+}
+
+func (g *inflightGroup) init() {
+	for i := range g.shards {
+		g.shards[i].m = make(map[int]*inflightCall)
+	}
+}
+
+func (g *inflightGroup) shard(id int) *inflightShard {
+	return &g.shards[uint(id)%inflightShards]
+}
+
+// do runs fn once per id at a time; callers arriving while a load is running
+// wait for it and share its result. The entry is removed when fn returns or
+// panics, so the map never retains finished loads.
+func (g *inflightGroup) do(id int, fn func() (User, bool)) (User, bool) {
+	s := g.shard(id)
+	s.mu.Lock()
+	if c, ok := s.m[id]; ok {
+		s.mu.Unlock()
+		<-c.done
+		return c.user, c.ok
+	}
+	c := &inflightCall{done: make(chan struct{})}
+	s.m[id] = c
+	s.mu.Unlock()
+
+	g.run(s, id, c, fn)
+	return c.user, c.ok
+}
+
+// doCtx is do where every caller, including the one that started the load,
+// stops waiting once ctx is done. The load itself runs in a goroutine started
+// by spawn and carries on for the remaining callers; if spawn has no room the
+// caller that starts the load runs it itself and cannot give up early.
+func (g *inflightGroup) doCtx(ctx context.Context, id int, fn func() (User, bool), spawn func(func()) bool) (User, bool, error) {
+	s := g.shard(id)
+	s.mu.Lock()
+	c, ok := s.m[id]
+	if !ok {
+		c = &inflightCall{done: make(chan struct{})}
+		s.m[id] = c
+	}
+	s.mu.Unlock()
+	if !ok && !spawn(func() { g.run(s, id, c, fn) }) {
+		g.run(s, id, c, fn)
+	}
+
+	select {
+	case <-c.done:
+		return c.user, c.ok, nil
+	case <-ctx.Done():
+		return User{}, false, ctx.Err()
+	}
+}
+
+// doMany is do for a batch of ids: ids already being loaded, by do or by
+// another batch, are waited for, and the rest are loaded together by a single
+// call of fn, so every id is loaded once however the batches overlap. fn
+// returns the users it found; ids missing from the result count as not found.
+func (g *inflightGroup) doMany(ids []int, fn func(ids []int) map[int]User) map[int]User {
+	var mine []int
+	calls := make(map[int]*inflightCall, len(ids))
+	for _, id := range ids {
+		if _, dup := calls[id]; dup {
+			continue
+		}
+		s := g.shard(id)
+		s.mu.Lock()
+		c, ok := s.m[id]
+		if !ok {
+			c = &inflightCall{done: make(chan struct{})}
+			s.m[id] = c
+			mine = append(mine, id)
+		}
+		s.mu.Unlock()
+		calls[id] = c
+	}
+
+	if len(mine) > 0 {
+		g.runMany(mine, calls, fn)
+	}
+
+	found := make(map[int]User, len(calls))
+	for id, c := range calls {
+		<-c.done
+		if c.ok {
+			found[id] = c.user
+		}
+	}
+	return found
+}
+
+func (g *inflightGroup) runMany(ids []int, calls map[int]*inflightCall, fn func(ids []int) map[int]User) {
+	defer func() {
+		for _, id := range ids {
+			s := g.shard(id)
+			s.mu.Lock()
+			delete(s.m, id)
+			s.mu.Unlock()
+			close(calls[id].done)
+		}
+	}()
+
+	found := fn(ids)
+	for _, id := range ids {
+		calls[id].user, calls[id].ok = found[id]
+	}
+}
+
+func (g *inflightGroup) run(s *inflightShard, id int, c *inflightCall, fn func() (User, bool)) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.m, id)
+		s.mu.Unlock()
+		close(c.done)
+	}()
+
+	c.user, c.ok = fn()
+}
+
+// start runs fn in a goroutine started by spawn unless a load of id is
+// already in flight, in which case it does nothing. It reports whether a load
+// was started.
+func (g *inflightGroup) start(id int, fn func() (User, bool), spawn func(func()) bool) bool {
+	s := g.shard(id)
+	s.mu.Lock()
+	if _, ok := s.m[id]; ok {
+		s.mu.Unlock()
+		return false
+	}
+	s.mu.Unlock()
+
+	return spawn(func() {
+		g.do(id, fn)
+	})
+}
+
+func (g *inflightGroup) len() int {
+	n := 0
+	for i := range g.shards {
+		s := &g.shards[i]
+		s.mu.Lock()
+		n += len(s.m)
+		s.mu.Unlock()
+	}
+	return n
+}
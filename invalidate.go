@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type pendingRefresh struct {
+	t *time.Timer
+}
+
+type refreshScheduler struct {
+	mu      sync.Mutex
+	pending map[int]*pendingRefresh
+}
+
+// Invalidate marks id's cached entry as out of date. Without
+// InvalidateDebounce the entry is dropped and the next Get reloads it. With
+// it, the entry is refreshed from the db once no further Invalidate of id has
+// arrived for the debounce window; a write to id in the meantime cancels the
+// refresh.
+func (u *UserRepo) Invalidate(id int) {
+	if !u.ready.Load() {
+		return
+	}
+	if u.cfg.InvalidateDebounce == 0 {
+		u.removeFromCache(id)
+		return
+	}
+
+	s := &u.refreshes
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p := s.pending[id]; p != nil {
+		p.t.Stop()
+	}
+	p := &pendingRefresh{}
+	s.pending[id] = p
+	p.t = time.AfterFunc(u.cfg.InvalidateDebounce, func() {
+		s.mu.Lock()
+		if s.pending[id] != p {
+			s.mu.Unlock()
+			return
+		}
+		delete(s.pending, id)
+		s.mu.Unlock()
+
+		refresh := func() {
+			u.loads.do(id, func() (User, bool) {
+				return u.refresh(id)
+			})
+		}
+		// without room for the refresh the entry is dropped instead, so the
+		// next Get reloads it
+		if !u.spawn(refresh) {
+			u.removeFromCache(id)
+		}
+	})
+}
+
+func (s *refreshScheduler) cancel(id int) {
+	s.mu.Lock()
+	if p := s.pending[id]; p != nil {
+		p.t.Stop()
+		delete(s.pending, id)
+	}
+	s.mu.Unlock()
+}
+
+func (s *refreshScheduler) cancelAll() {
+	s.mu.Lock()
+	for id, p := range s.pending {
+		p.t.Stop()
+		delete(s.pending, id)
+	}
+	s.mu.Unlock()
+}
+
+// refresh reloads id from the db into the cache, dropping the cached entry if
+// the db no longer has it. Refreshes of the same id run one at a time, so an
+// older db read cannot land in the cache after a newer one; refreshes of
+// different ids do not wait for each other.
+func (u *UserRepo) refresh(id int) (User, bool) {
+	u.refreshLocks.lock(id)
+	defer u.refreshLocks.unlock(id)
+
+	user, ok := u.loadFromDB(id)
+	if !ok {
+		u.removeFromCache(id)
+	}
+	return user, ok
+}
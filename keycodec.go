@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// KeyCodec maps the cache's int ids to the string keys used by external
+// stores and back.
+type KeyCodec interface {
+	Encode(id int) string
+	Decode(key string) (int, error)
+}
+
+// PrefixKeyCodec namespaces ids as Prefix followed by the decimal id.
+type PrefixKeyCodec struct {
+	Prefix string
+}
+
+var DefaultKeyCodec KeyCodec = PrefixKeyCodec{Prefix: "user:"}
+
+func (c PrefixKeyCodec) Encode(id int) string {
+	return c.Prefix + strconv.Itoa(id)
+}
+
+func (c PrefixKeyCodec) Decode(key string) (int, error) {
+	s, ok := strings.CutPrefix(key, c.Prefix)
+	if !ok {
+		return 0, fmt.Errorf("key %q is not in namespace %q", key, c.Prefix)
+	}
+	return strconv.Atoi(s)
+}
@@ -0,0 +1,50 @@
+package main
+
+import "sync"
+
+type keyedEntry struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// keyedMutex is a mutex per id. An id's entry exists only while some
+// goroutine holds or waits for it, so the map does not grow with the number
+// of ids ever locked. The zero value is ready to use.
+type keyedMutex struct {
+	mu sync.Mutex
+	m  map[int]*keyedEntry
+}
+
+func (k *keyedMutex) lock(id int) {
+	k.mu.Lock()
+	if k.m == nil {
+		k.m = make(map[int]*keyedEntry)
+	}
+	e := k.m[id]
+	if e == nil {
+		e = &keyedEntry{}
+		k.m[id] = e
+	}
+	e.refs++
+	k.mu.Unlock()
+
+	e.mu.Lock()
+}
+
+func (k *keyedMutex) unlock(id int) {
+	k.mu.Lock()
+	e := k.m[id]
+	e.refs--
+	if e.refs == 0 {
+		delete(k.m, id)
+	}
+	k.mu.Unlock()
+
+	e.mu.Unlock()
+}
+
+func (k *keyedMutex) len() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.m)
+}
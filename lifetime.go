@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// LifetimeBuckets are the upper bounds of the Stats.Lifetimes histogram
+// buckets; the last bucket counts lifetimes of 10 minutes or more.
+var LifetimeBuckets = [...]time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+	time.Minute,
+	10 * time.Minute,
+}
+
+type LifetimeHistogram [len(LifetimeBuckets) + 1]uint64
+
+// lifetimeTracker records when each cached entry was written and, when it is
+// overwritten or removed, adds how long it lived to the histogram.
+type lifetimeTracker struct {
+	mu   sync.Mutex
+	born map[int]time.Time
+	hist LifetimeHistogram
+}
+
+func (t *lifetimeTracker) init() {
+	t.born = make(map[int]time.Time)
+}
+
+func (t *lifetimeTracker) start(id int) {
+	now := time.Now()
+	t.mu.Lock()
+	if b, ok := t.born[id]; ok {
+		t.record(now.Sub(b))
+	}
+	t.born[id] = now
+	t.mu.Unlock()
+}
+
+func (t *lifetimeTracker) end(id int) {
+	now := time.Now()
+	t.mu.Lock()
+	if b, ok := t.born[id]; ok {
+		t.record(now.Sub(b))
+		delete(t.born, id)
+	}
+	t.mu.Unlock()
+}
+
+func (t *lifetimeTracker) record(d time.Duration) {
+	i := 0
+	for i < len(LifetimeBuckets) && d >= LifetimeBuckets[i] {
+		i++
+	}
+	t.hist[i]++
+}
+
+// resetHist clears the histogram but keeps tracking the live entries.
+func (t *lifetimeTracker) resetHist() {
+	t.mu.Lock()
+	t.hist = LifetimeHistogram{}
+	t.mu.Unlock()
+}
+
+func (t *lifetimeTracker) snapshot() LifetimeHistogram {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.hist
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// Loader fetches a user from some source outside the repo. It reports false
+// if the source does not have the id and an error if the source failed.
+type Loader func(id int) (User, bool, error)
+
+// RetryBudget bounds the loader calls of one load as a whole, across all
+// loaders of the chain and their retries, so retries cannot multiply. The
+// zero RetryBudget calls each loader once without retrying.
+type RetryBudget struct {
+	// MaxAttempts caps the loader calls; zero means no cap, unless only
+	// Backoff is set, in which case defaultRetryAttempts applies.
+	MaxAttempts int
+	// MaxTime caps the time spent in loaders and backoff; zero means no
+	// limit.
+	MaxTime time.Duration
+	// Backoff is the base wait before retrying a failed loader. Each wait
+	// is drawn uniformly from [Backoff/2, 3*Backoff/2).
+	Backoff time.Duration
+}
+
+// defaultRetryAttempts caps the loader calls of a budget that sets Backoff
+// but neither MaxAttempts nor MaxTime, so a failing loader is not retried
+// forever.
+const defaultRetryAttempts = 3
+
+// allows reports whether the budget allows another call after attempts
+// calls made since start, if the next one waits wait first.
+func (b RetryBudget) allows(attempts int, start time.Time, wait time.Duration) bool {
+	max := b.MaxAttempts
+	if max == 0 && b.MaxTime == 0 && b.Backoff > 0 {
+		max = defaultRetryAttempts
+	}
+	if max > 0 && attempts >= max {
+		return false
+	}
+	return b.MaxTime == 0 || time.Since(start)+wait < b.MaxTime
+}
+
+func (b RetryBudget) jitter() time.Duration {
+	if b.Backoff <= 0 {
+		return 0
+	}
+	return b.Backoff/2 + rand.N(b.Backoff)
+}
+
+// SetLoaderChain sets the loaders tried in order on a cache miss, after
+// Secondary and before the db. The first one that finds the user wins and
+// its value is cached. A loader error is logged and the loader is retried
+// while the load's RetryBudget allows, then the next loader is tried, unless
+// StopOnLoaderError is set, in which case the load ends as a miss. A load
+// that runs out of budget ends as a miss too. Calling it with no loaders
+// removes the chain.
+func (u *UserRepo) SetLoaderChain(loaders ...Loader) {
+	chain := append([]Loader(nil), loaders...)
+	u.loaders.Store(&chain)
+}
+
+// loadFromChain reports stop if a loader error or the budget ended the load.
+// Once ctx is done no loader is retried, but the remaining loaders still get
+// their first call and the db fallback still runs.
+func (u *UserRepo) loadFromChain(ctx context.Context, id int, budget RetryBudget) (user User, ok, stop bool) {
+	chain := u.loaders.Load()
+	if chain == nil {
+		return User{}, false, false
+	}
+
+	start := time.Now()
+	attempts := 0
+	for _, load := range *chain {
+		for retry := false; ; retry = true {
+			var wait time.Duration
+			if retry {
+				wait = budget.jitter()
+				if ctx.Err() != nil || !budget.allows(attempts, start, wait) {
+					break
+				}
+				if !sleepCtx(ctx, wait) {
+					break
+				}
+			} else if !budget.allows(attempts, start, 0) {
+				return User{}, false, true
+			}
+
+			attempts++
+			user, ok, err := load(id)
+			if err == nil {
+				if ok {
+					u.storeInCache(id, user)
+					return user, true, false
+				}
+				break
+			}
+			u.logFor(id).Println(loaderFailed, id, err)
+			if u.cfg.StopOnLoaderError {
+				return User{}, false, true
+			}
+			if budget == (RetryBudget{}) {
+				break
+			}
+		}
+	}
+	return User{}, false, false
+}
+
+// sleepCtx waits for d and reports false if ctx was done first.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
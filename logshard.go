@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"sync"
+)
+
+type logShard struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	l   *log.Logger
+}
+
+func (s *logShard) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(p)
+}
+
+// initLogShards gives every shard its own logger with the repo logger's
+// prefix and flags, writing to its own buffer.
+func (u *UserRepo) initLogShards(n int) {
+	u.logShards = make([]logShard, n)
+	for i := range u.logShards {
+		s := &u.logShards[i]
+		s.l = log.New(s, u.logger.Prefix(), u.logger.Flags())
+	}
+}
+
+// logFor returns the logger for messages about id: with LogShards, the
+// shard logger id hashes to, so logging for different ids rarely contends.
+func (u *UserRepo) logFor(id int) *log.Logger {
+	if len(u.logShards) == 0 {
+		return u.logger
+	}
+	return u.logShards[uint(id)%uint(len(u.logShards))].l
+}
+
+// flushLogs appends every shard's buffered lines to the repo logger's output,
+// shard after shard, so lines of different shards are not in time order. It
+// writes to the output directly and must not run concurrently with logging
+// through the repo logger.
+func (u *UserRepo) flushLogs() {
+	if len(u.logShards) == 0 {
+		return
+	}
+	w := u.logger.Writer()
+	for i := range u.logShards {
+		s := &u.logShards[i]
+		s.mu.Lock()
+		w.Write(s.buf.Bytes())
+		s.buf.Reset()
+		s.mu.Unlock()
+	}
+}
@@ -2,10 +2,29 @@ package main
 
 import (
 	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"iter"
 	"log"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unique"
+	"unsafe"
 )
 
 const (
@@ -14,145 +33,1619 @@ const (
 	foundInDB       = "found in db!!"
 	notFoundInDB    = "not found in db"
 	appIsStarted    = "app is started!"
+	gossipApplied   = "applied gossip write"
+	cacheRepaired   = "cache disagreed with db, repaired"
+	foundInL2       = "found in secondary cache"
+	mirrorFailed    = "mirror write failed:"
+	loaderFailed    = "loader failed:"
 )
 
+var (
+	ErrDraining      = errors.New("user repo is draining")
+	ErrInvalidConfig = errors.New("invalid cache config")
+	// ErrNotInitialized is returned by writes to a UserRepo whose Init has
+	// not succeeded; reads on such a repo report a miss and the other
+	// methods do nothing.
+	ErrNotInitialized = errors.New("user repo is not initialized")
+	ErrFull           = errors.New("cache is full")
+)
+
+// ContextKey is the type of the context keys UserRepo looks at in GetCtx.
+type ContextKey int
+
+const (
+	// BypassCacheKey set to true makes GetCtx skip the cache, read the db
+	// and refresh the cached entry from it.
+	BypassCacheKey ContextKey = iota
+	// RetryBudgetKey set to a RetryBudget lets the loader chain retry failed
+	// loaders within that budget when GetCtx loads.
+	RetryBudgetKey
+)
+
+type HealthStatus struct {
+	Healthy     bool
+	Initialized bool
+	Draining    bool
+	Kind        CacheKind
+	Entries     int
+}
+
+type Cache interface {
+	Get(id int) (User, bool)
+	Store(id int, user User) error
+}
+
+type CacheConfig struct {
+	Kind CacheKind
+	// LockPreference picks the lock of the CacheRWMutex backend; other
+	// backends ignore it.
+	LockPreference LockPreference
+	// VerifyOnGet is the probability in [0, 1] that a cache hit is checked
+	// against the db and repaired if they disagree.
+	VerifyOnGet float64
+	// MaxValueBytes keeps users whose estimated size exceeds it out of the
+	// cache; they are still written to the db. Zero means no limit.
+	MaxValueBytes int
+	// MaxEntries bounds the cache to this many entries. Under OverflowEvict
+	// only the sync.Map backend honours it, roughly, see syncMapCache, and
+	// Init rejects it for the others; under OverflowReject and OverflowBlock
+	// every backend does. Zero means unbounded.
+	MaxEntries int
+	// Overflow picks what happens to a Store of a new id once MaxEntries is
+	// reached. With OverflowReject or OverflowBlock the bound holds for every
+	// backend, and loads on a full cache are returned without being cached.
+	Overflow OverflowPolicy
+	// MaxCost enables cost-based eviction once the summed cost of cached
+	// entries exceeds it, see costTracker. Zero disables cost tracking.
+	MaxCost int64
+	// MaxDBEntries bounds the db too: a write of a new id beyond it drops
+	// an arbitrary other user from the db and the cache. Zero means
+	// unbounded.
+	MaxDBEntries int
+	// CacheOnly drops the db entirely: Store only writes the cache and a
+	// cache miss is final.
+	CacheOnly bool
+	// LogShards, if non-zero, splits the per-operation log into that many
+	// buffers picked by id, so goroutines working on different ids do not
+	// serialize on one logger. The buffers are appended to the repo logger's
+	// output on Close.
+	LogShards int
+	// StatsInterval, if non-zero, logs Stats to the repo logger at that
+	// interval until Close.
+	StatsInterval time.Duration
+	// WriteCoalesceWindow, if non-zero, buffers a Store for that long and
+	// writes only the last value stored for the id within the window. Reads
+	// see the buffered value.
+	WriteCoalesceWindow time.Duration
+	// InvalidateDebounce turns Invalidate into a refresh that runs once per
+	// burst of invalidations, see UserRepo.Invalidate.
+	InvalidateDebounce time.Duration
+	// EvictOnGC is the fraction of unpinned cached entries dropped after every
+	// GC cycle, letting the cache shrink when the process allocates heavily.
+	// Zero disables it.
+	EvictOnGC float64
+	// PublishInterval is how often the CacheSnapshot backend republishes its
+	// read snapshot, bounding read staleness. Zero means 1ms.
+	PublishInterval time.Duration
+	// TrackLifetimes records how long cached entries live before they are
+	// overwritten or removed, reported in Stats.Lifetimes.
+	TrackLifetimes bool
+	// TrackHotKeys counts cache hits per cached id for TopKeys.
+	TrackHotKeys bool
+	// TrackHitWindows reports the hit ratio of the last minute and the last
+	// 5 minutes in Stats, next to the cumulative one.
+	TrackHitWindows bool
+	// TTI expires a cached entry that has not been read or written for that
+	// long; every hit restarts its idle timer. Zero disables it.
+	TTI time.Duration
+	// Intern canonicalizes cached users through the unique package so equal
+	// users stored under different ids share one Name backing array. The
+	// canonical copy is reclaimed by the GC once no entry refers to it.
+	Intern bool
+	// Secondary, if set, is consulted on a local miss before the db and hits
+	// are copied into the local cache.
+	Secondary Cache
+	// AsyncWorkers bounds the goroutines running background work: GetAsync
+	// loads, debounced refreshes, GetCtx loads and coalesced write flushes.
+	// Work that finds no room is counted in Stats.AsyncRejected; a GetAsync
+	// load is skipped, a refresh drops the entry instead, a GetCtx load runs
+	// in the caller and a coalesced Store is written at once. Zero means
+	// unbounded.
+	AsyncWorkers int
+	// Authorize, if set, is called first by GetCtx and StoreCtx; an error
+	// from it is returned to the caller before the cache or the db is used.
+	Authorize func(ctx context.Context, id int) error
+	// StopOnLoaderError ends a load as a miss at the first loader error
+	// instead of trying the next loader, see UserRepo.SetLoaderChain.
+	StopOnLoaderError bool
+}
+
+// defaultPublishInterval is the PublishInterval used when it is zero.
+const defaultPublishInterval = time.Millisecond
+
+func (c CacheConfig) validate() error {
+	switch {
+	case c.Kind < CacheRWMutex || c.Kind > CacheMutex:
+		return fmt.Errorf("%w: unknown cache kind %d", ErrInvalidConfig, c.Kind)
+	case c.Overflow < OverflowEvict || c.Overflow > OverflowBlock:
+		return fmt.Errorf("%w: unknown overflow policy %d", ErrInvalidConfig, c.Overflow)
+	case c.LockPreference < LockStd || c.LockPreference > LockPreferWriters:
+		return fmt.Errorf("%w: unknown lock preference %d", ErrInvalidConfig, c.LockPreference)
+	case c.VerifyOnGet < 0 || c.VerifyOnGet > 1:
+		return fmt.Errorf("%w: VerifyOnGet %v is not in [0, 1]", ErrInvalidConfig, c.VerifyOnGet)
+	case c.EvictOnGC < 0 || c.EvictOnGC > 1:
+		return fmt.Errorf("%w: EvictOnGC %v is not in [0, 1]", ErrInvalidConfig, c.EvictOnGC)
+	case c.MaxValueBytes < 0 || c.MaxEntries < 0 || c.MaxCost < 0 || c.MaxDBEntries < 0 || c.AsyncWorkers < 0 || c.LogShards < 0:
+		return fmt.Errorf("%w: size limits must not be negative", ErrInvalidConfig)
+	case c.MaxEntries > 0 && c.Overflow == OverflowEvict && c.Kind != CacheSyncMap:
+		return fmt.Errorf("%w: %s backend has no entry bound", ErrInvalidConfig, c.Kind)
+	case c.StatsInterval < 0 || c.WriteCoalesceWindow < 0 || c.InvalidateDebounce < 0 || c.PublishInterval < 0 || c.TTI < 0:
+		return fmt.Errorf("%w: durations must not be negative", ErrInvalidConfig)
+	}
+	return nil
+}
+
 type User struct {
-	Name string
+	Name    string
+	Counter int
+}
+
+func (u User) size() int {
+	return int(unsafe.Sizeof(u)) + len(u.Name)
+}
+
+type UserRepo struct {
+	o         sync.Once
+	dbMutex   sync.Mutex
+	db        map[int]User
+	versions  map[int]entryVersion
+	seq       uint64
+	peerMarks map[*UserRepo]uint64
+	// aggregates is guarded by dbMutex.
+	aggregates map[string]aggregateEntry
+	loads      inflightGroup
+	cfg        CacheConfig
+	cache      atomic.Pointer[cacheRef]
+	stats      repoStats
+	costs      costTracker
+	coalescer  writeCoalescer
+	pins       pinSet
+	refreshes  refreshScheduler
+	// refreshLocks serializes refresh per id.
+	refreshLocks keyedMutex
+	lifetimes    lifetimeTracker
+	hitWindow    hitWindow
+	hotKeys      hitCounter
+	idle         idleTracker
+	clock        func() time.Time
+	ready        atomic.Bool
+	draining     atomic.Bool
+	writes       atomic.Int64
+	// trackUse keeps idle recording last use without TTI, for Resize.
+	trackUse atomic.Bool
+	// maxEntries is MaxEntries when the repo rather than the backend
+	// enforces it, see OverflowPolicy.
+	maxEntries atomic.Int64
+	mirrorTo   atomic.Pointer[mirrorRef]
+	async      asyncPool
+	loaders    atomic.Pointer[[]Loader]
+	closeOnce  sync.Once
+	done       chan struct{}
+	bg         sync.WaitGroup
+	gcCycles   chan struct{}
+	initErr    error
+	logger     *log.Logger
+	logShards  []logShard
+}
+
+func (u *UserRepo) backend() cacheBackend {
+	return u.cache.Load().cacheBackend
+}
+
+func (u *UserRepo) getFromCache(id int) (User, bool) {
+	user, reason := u.lookup(id)
+	return user, reason == MissNone
+}
+
+// lookup is getFromCache reporting why the cache missed.
+func (u *UserRepo) lookup(id int) (User, MissReason) {
+	if u.cfg.WriteCoalesceWindow > 0 {
+		if user, ok := u.coalescer.get(id); ok {
+			u.countHit(id)
+			return user, MissNone
+		}
+	}
+
+	reason := MissNone
+	user, ok := u.backend().load(id)
+	if !ok {
+		reason = MissCold
+	} else if u.cfg.TTI > 0 && u.idle.expired(id, u.clock(), u.cfg.TTI) {
+		u.removeFromCache(id)
+		reason = MissExpired
+	}
+	if reason != MissNone {
+		u.countMiss(id, reason)
+		return User{}, reason
+	}
+
+	if u.cfg.MaxCost > 0 {
+		u.costs.touch(id)
+	}
+	if u.cfg.TTI == 0 && u.trackUse.Load() {
+		u.idle.touch(id, u.clock())
+	}
+	u.countHit(id)
+
+	return user, MissNone
+}
+
+func (u *UserRepo) countHit(id int) {
+	u.stats.hits.Add(1)
+	if u.cfg.TrackHotKeys {
+		u.hotKeys.hit(id)
+	}
+	if u.cfg.TrackHitWindows {
+		u.hitWindow.record(u.clock(), true)
+	}
+	u.logFor(id).Println(foundInCache)
+}
+
+func (u *UserRepo) countMiss(id int, reason MissReason) {
+	u.stats.misses.Add(1)
+	u.stats.countMiss(reason)
+	if u.cfg.TrackHitWindows {
+		u.hitWindow.record(u.clock(), false)
+	}
+	u.logFor(id).Println(notFoundInCache)
+}
+
+func (u *UserRepo) storeInCache(id int, user User) {
+	u.storeInCacheWithCost(id, user, 0)
+}
+
+func (u *UserRepo) storeInCacheWithCost(id int, user User, cost int64) (User, bool) {
+	if u.cfg.MaxValueBytes > 0 && user.size() > u.cfg.MaxValueBytes {
+		u.removeFromCache(id)
+		u.stats.oversizedSkipped.Add(1)
+		return User{}, false
+	}
+	if u.full(id) {
+		return User{}, false
+	}
+	if u.cfg.Intern {
+		user = unique.Make(user).Value()
+	}
+	c := u.backend()
+	old, ok := c.swap(id, user)
+	if u.cfg.TrackLifetimes {
+		u.lifetimes.start(id)
+	}
+	if u.cfg.TTI > 0 || u.trackUse.Load() {
+		u.idle.touch(id, u.clock())
+	}
+
+	if u.cfg.MaxCost > 0 {
+		u.costs.put(id, cost, func(id int) {
+			c.delete(id)
+			u.stats.costEvicted.Add(1)
+			u.onEvict(id)
+		})
+	}
+
+	return old, ok
+}
+
+func (u *UserRepo) removeFromCache(id int) {
+	u.backend().delete(id)
+	u.forget(id)
+}
+
+// forget drops the bookkeeping kept for a cached entry that was removed.
+func (u *UserRepo) forget(id int) {
+	if u.cfg.TTI > 0 || u.trackUse.Load() {
+		u.idle.forget(id)
+	}
+	if u.cfg.MaxCost > 0 {
+		u.costs.remove(id)
+	}
+	if u.cfg.TrackLifetimes {
+		u.lifetimes.end(id)
+	}
+	if u.cfg.TrackHotKeys {
+		u.hotKeys.forget(id)
+	}
+}
+
+// onBoundEvict is the backend's callback for entries dropped to stay within
+// MaxEntries. Unlike cost eviction it runs outside the cost tracker, so the
+// entry's cost is dropped along with the rest of its bookkeeping.
+func (u *UserRepo) onBoundEvict(id int) {
+	u.stats.boundEvicted.Add(1)
+	u.forget(id)
+}
+
+// onEvict is called for entries dropped by a backend bound or by cost
+// eviction rather than through removeFromCache.
+func (u *UserRepo) onEvict(id int) {
+	if u.cfg.TTI > 0 || u.trackUse.Load() {
+		u.idle.forget(id)
+	}
+	if u.cfg.TrackLifetimes {
+		u.lifetimes.end(id)
+	}
+	if u.cfg.TrackHotKeys {
+		u.hotKeys.forget(id)
+	}
+}
+
+// Keys returns a snapshot of the cached ids. It is O(n) in the cache size and
+// the returned slice is a copy that later writes do not affect.
+func (u *UserRepo) Keys() []int {
+	if !u.ready.Load() {
+		return nil
+	}
+	return u.backend().keys()
+}
+
+// All iterates a copy of the cached entries taken when the iteration starts,
+// so later writes do not show up in it.
+func (u *UserRepo) All() iter.Seq2[int, User] {
+	return func(yield func(int, User) bool) {
+		if !u.ready.Load() {
+			return
+		}
+		for id, user := range u.backend().snapshot() {
+			if !yield(id, user) {
+				return
+			}
+		}
+	}
+}
+
+func (u *UserRepo) Get(id int) (User, bool) {
+	if !u.ready.Load() {
+		return User{}, false
+	}
+	if v, ok := u.getVerified(id); ok {
+		return v, true
+	}
+
+	return u.loads.do(id, func() (User, bool) {
+		return u.load(id)
+	})
+}
+
+// getVerified is getFromCache with the VerifyOnGet sampling applied.
+func (u *UserRepo) getVerified(id int) (User, bool) {
+	v, ok := u.getFromCache(id)
+	if ok {
+		v = u.sampleVerify(id, v)
+	}
+	return v, ok
+}
+
+// sampleVerify checks a cache hit against the db with probability
+// VerifyOnGet and returns the value to serve.
+func (u *UserRepo) sampleVerify(id int, cached User) User {
+	if u.cfg.VerifyOnGet > 0 && !u.cfg.CacheOnly && rand.Float64() < u.cfg.VerifyOnGet {
+		return u.verify(id, cached)
+	}
+	return cached
+}
+
+// GetWithMetadata is Get that also reports whether the cache answered and,
+// if not, why: a cold miss, an entry expired by TTI, or MissNotInDB when the
+// load found nothing either.
+func (u *UserRepo) GetWithMetadata(id int) (User, GetMetadata) {
+	if !u.ready.Load() {
+		return User{}, GetMetadata{MissReason: MissNotInDB}
+	}
+	user, reason := u.lookup(id)
+	if reason == MissNone {
+		return u.sampleVerify(id, user), GetMetadata{Found: true, CacheHit: true}
+	}
+
+	user, ok := u.loads.do(id, func() (User, bool) {
+		return u.load(id)
+	})
+	if !ok {
+		reason = MissNotInDB
+	}
+	return user, GetMetadata{Found: ok, MissReason: reason}
+}
+
+// GetOrDefault is Get returning def on a miss; def is never stored.
+func (u *UserRepo) GetOrDefault(id int, def User) User {
+	if user, ok := u.Get(id); ok {
+		return user
+	}
+	return def
+}
+
+// GetAsync answers from the cache only. On a miss it returns immediately and
+// starts a background load, coalesced per id, so a later call can hit.
+func (u *UserRepo) GetAsync(id int) (User, bool) {
+	if !u.ready.Load() {
+		return User{}, false
+	}
+	if v, ok := u.getFromCache(id); ok {
+		return v, true
+	}
+
+	u.loads.start(id, func() (User, bool) {
+		return u.load(id)
+	}, u.spawn)
+
+	return User{}, false
+}
+
+func (u *UserRepo) load(id int) (User, bool) {
+	return u.loadCtx(context.Background(), id, RetryBudget{})
+}
+
+// loadCtx is load retrying the loader chain within budget, and only while
+// ctx is not done.
+func (u *UserRepo) loadCtx(ctx context.Context, id int, budget RetryBudget) (User, bool) {
+	if u.cfg.Secondary != nil {
+		if user, ok := u.loadFromSecondary(id); ok {
+			return user, true
+		}
+	}
+	if user, ok, stop := u.loadFromChain(ctx, id, budget); ok || stop {
+		return user, ok
+	}
+	return u.loadFromDB(id)
+}
+
+func (u *UserRepo) loadFromSecondary(id int) (User, bool) {
+	user, ok := u.cfg.Secondary.Get(id)
+	if !ok {
+		u.stats.l2Misses.Add(1)
+		return User{}, false
+	}
+
+	u.storeInCache(id, user)
+
+	u.stats.l2Hits.Add(1)
+	u.logFor(id).Println(foundInL2)
+
+	return user, true
+}
+
+// GetCtx is Get checked by Authorize, that stops waiting for a load once ctx
+// is done and returns ctx's error; the load goes on and still fills the cache
+// for other callers. A load started by GetCtx uses the RetryBudget in ctx;
+// callers joining it share that load and its budget, but not its deadline:
+// the load runs without ctx's cancellation, so a caller giving up never turns
+// it into a miss for the others.
+func (u *UserRepo) GetCtx(ctx context.Context, id int) (User, bool, error) {
+	if !u.ready.Load() {
+		return User{}, false, nil
+	}
+	if u.cfg.Authorize != nil {
+		if err := u.cfg.Authorize(ctx, id); err != nil {
+			return User{}, false, err
+		}
+	}
+	if bypass, _ := ctx.Value(BypassCacheKey).(bool); bypass && !u.cfg.CacheOnly {
+		user, ok := u.refresh(id)
+		return user, ok, nil
+	}
+
+	if v, ok := u.getVerified(id); ok {
+		return v, true, nil
+	}
+	budget, _ := ctx.Value(RetryBudgetKey).(RetryBudget)
+	shared := context.WithoutCancel(ctx)
+	return u.loads.doCtx(ctx, id, func() (User, bool) {
+		return u.loadCtx(shared, id, budget)
+	}, u.spawn)
+}
+
+func (u *UserRepo) verify(id int, cached User) User {
+	// a hit on a buffered Store is newer than the db until it is flushed
+	if u.cfg.WriteCoalesceWindow > 0 {
+		if pending, ok := u.coalescer.get(id); ok && pending == cached {
+			return cached
+		}
+	}
+
+	u.dbMutex.Lock()
+	user, ok := u.db[id]
+	u.dbMutex.Unlock()
+	if ok && user == cached {
+		return cached
+	}
+
+	u.stats.discrepancies.Add(1)
+	if !ok {
+		return cached
+	}
+	u.storeInCache(id, user)
+	u.logFor(id).Println(cacheRepaired)
+
+	return user
+}
+
+func (u *UserRepo) GetIfPresent(id int) (User, bool) {
+	if !u.ready.Load() {
+		return User{}, false
+	}
+	return u.getFromCache(id)
+}
+
+// GetManyPartial looks ids up in the cache only and splits them into the
+// users found and the ids the caller still has to load.
+func (u *UserRepo) GetManyPartial(ids []int) (map[int]User, []int) {
+	found := make(map[int]User, len(ids))
+	if !u.ready.Load() {
+		return found, append([]int(nil), ids...)
+	}
+	var missing []int
+	for _, id := range ids {
+		if user, ok := u.getFromCache(id); ok {
+			found[id] = user
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	return found, missing
+}
+
+// GetMany is Get for several ids, returning the users found. The ids missed
+// by the cache are loaded as one batch, sharing loads with concurrent Get and
+// GetMany calls so that each id is loaded once.
+func (u *UserRepo) GetMany(ids []int) map[int]User {
+	found := make(map[int]User, len(ids))
+	if !u.ready.Load() {
+		return found
+	}
+
+	var missing []int
+	for _, id := range ids {
+		if user, ok := u.getVerified(id); ok {
+			found[id] = user
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return found
+	}
+	for id, user := range u.loads.doMany(missing, u.loadMany) {
+		found[id] = user
+	}
+	return found
+}
+
+// loadMany reads all ids from the db under one lock. With a Secondary or a
+// loader chain it falls back to loading id by id.
+func (u *UserRepo) loadMany(ids []int) map[int]User {
+	found := make(map[int]User, len(ids))
+	if u.cfg.Secondary != nil || u.loaders.Load() != nil || u.cfg.CacheOnly {
+		for _, id := range ids {
+			if user, ok := u.load(id); ok {
+				found[id] = user
+			}
+		}
+		return found
+	}
+
+	u.dbMutex.Lock()
+	for _, id := range ids {
+		if user, ok := u.db[id]; ok {
+			found[id] = user
+		}
+	}
+	u.dbMutex.Unlock()
+
+	for _, id := range ids {
+		user, ok := found[id]
+		if !ok {
+			u.stats.dbMisses.Add(1)
+			u.logFor(id).Println(notFoundInDB)
+			continue
+		}
+		u.storeInCache(id, user)
+		u.stats.dbHits.Add(1)
+		u.logFor(id).Println(foundInDB)
+	}
+	return found
+}
+
+func (u *UserRepo) loadFromDB(id int) (User, bool) {
+	if u.cfg.CacheOnly {
+		return User{}, false
+	}
+
+	u.dbMutex.Lock()
+	user, ok := u.db[id]
+	u.dbMutex.Unlock()
+	if !ok {
+		u.stats.dbMisses.Add(1)
+		u.logFor(id).Println(notFoundInDB)
+		return User{}, false
+	}
+
+	u.storeInCache(id, user)
+
+	u.stats.dbHits.Add(1)
+	u.logFor(id).Println(foundInDB)
+
+	return user, true
+}
+
+func (u *UserRepo) Store(id int, user User) error {
+	return u.StoreWithCost(id, user, 1)
+}
+
+// StoreWithCost stores user like Store and, when MaxCost is set, gives its
+// cache entry the given cost: under pressure higher-cost entries are kept
+// longer than cheaper ones.
+func (u *UserRepo) StoreWithCost(id int, user User, cost int64) error {
+	return u.storeCtx(context.Background(), id, user, cost)
+}
+
+// StoreCtx is Store checked by Authorize, whose wait for room under
+// OverflowBlock ends with ctx's error once ctx is done.
+func (u *UserRepo) StoreCtx(ctx context.Context, id int, user User) error {
+	if u.cfg.Authorize != nil {
+		if err := u.cfg.Authorize(ctx, id); err != nil {
+			return err
+		}
+	}
+	return u.storeCtx(ctx, id, user, 1)
+}
+
+func (u *UserRepo) storeCtx(ctx context.Context, id int, user User, cost int64) error {
+	u.writes.Add(1)
+	defer u.writes.Add(-1)
+	if u.draining.Load() {
+		return ErrDraining
+	}
+	if !u.ready.Load() {
+		return ErrNotInitialized
+	}
+	if err := u.waitForRoom(ctx, id); err != nil {
+		return err
+	}
+
+	if u.cfg.WriteCoalesceWindow > 0 {
+		u.coalesce(id, user, cost)
+		return nil
+	}
+	u.write(id, user, cost)
+
+	return nil
+}
+
+// Swap stores user and returns the value it replaced and whether there was
+// one. The previous value comes from the db, which is read under the same
+// lock as the write, or from the cache in CacheOnly mode. With
+// WriteCoalesceWindow set, Swap is applied immediately and replaces any write
+// still buffered for id.
+func (u *UserRepo) Swap(id int, user User) (User, bool, error) {
+	u.writes.Add(1)
+	defer u.writes.Add(-1)
+	if u.draining.Load() {
+		return User{}, false, ErrDraining
+	}
+	if !u.ready.Load() {
+		return User{}, false, ErrNotInitialized
+	}
+	if err := u.waitForRoom(context.Background(), id); err != nil {
+		return User{}, false, err
+	}
+
+	if u.cfg.WriteCoalesceWindow > 0 {
+		u.coalescer.mu.Lock()
+		defer u.coalescer.mu.Unlock()
+		if w, ok := u.coalescer.pending[id]; ok {
+			delete(u.coalescer.pending, id)
+			u.write(id, user, 1)
+			return w.user, true, nil
+		}
+	}
+	old, ok := u.write(id, user, 1)
+
+	return old, ok, nil
+}
+
+func (u *UserRepo) write(id int, user User, cost int64) (User, bool) {
+	old, ok, _ := u.writeIf(id, user, cost, func() bool {
+		u.bumpVersion(id)
+		return true
+	})
+	return old, ok
+}
+
+// writeIf is write whose version step is left to accept, called with dbMutex
+// held before the db is touched; if it reports false nothing is written. In
+// CacheOnly mode there are no versions, accept is not called and the write
+// always goes through. It reports whether the write was made.
+func (u *UserRepo) writeIf(id int, user User, cost int64, accept func() bool) (User, bool, bool) {
+	if u.cfg.CacheOnly {
+		u.cancelRefresh(id)
+		old, ok := u.storeInCacheWithCost(id, user, cost)
+		u.mirror(id, user)
+		return old, ok, true
+	}
+
+	u.dbMutex.Lock()
+	if !accept() {
+		u.dbMutex.Unlock()
+		return User{}, false, false
+	}
+	u.cancelRefresh(id)
+	old, ok := u.db[id]
+	u.putDB(id, user)
+	u.dbMutex.Unlock()
+	u.storeInCacheWithCost(id, user, cost)
+	u.mirror(id, user)
+
+	return old, ok, true
+}
+
+func (u *UserRepo) cancelRefresh(id int) {
+	if u.cfg.InvalidateDebounce > 0 {
+		u.refreshes.cancel(id)
+	}
+}
+
+// putDB must be called with dbMutex held.
+func (u *UserRepo) putDB(id int, user User) {
+	u.putDBKeeping(id, user, nil)
+}
+
+// putDBKeeping is putDB that never picks an id in keep as the MaxDBEntries
+// victim.
+func (u *UserRepo) putDBKeeping(id int, user User, keep map[int]*User) {
+	_, exists := u.db[id]
+	u.db[id] = user
+	if exists || u.cfg.MaxDBEntries == 0 || len(u.db) <= u.cfg.MaxDBEntries {
+		return
+	}
+
+	for victim := range u.db {
+		if _, kept := keep[victim]; victim == id || kept {
+			continue
+		}
+		delete(u.db, victim)
+		delete(u.versions, victim)
+		u.removeFromCache(victim)
+		u.stats.dbEvicted.Add(1)
+		return
+	}
+}
+
+// DBLen returns the number of users in the db.
+func (u *UserRepo) DBLen() int {
+	u.dbMutex.Lock()
+	defer u.dbMutex.Unlock()
+	return len(u.db)
+}
+
+// Reload rebuilds the whole cache from the current db contents into a fresh
+// backend and swaps it in at once, so readers see either the old cache or the
+// complete new one. dbMutex is held while the new cache is built, which blocks
+// writers for the O(n) copy but keeps their writes from being lost by the
+// swap. In CacheOnly mode there is no db and Reload does nothing.
+func (u *UserRepo) Reload() {
+	if !u.ready.Load() || u.cfg.CacheOnly {
+		return
+	}
+
+	u.dbMutex.Lock()
+	defer u.dbMutex.Unlock()
+	next := newCacheBackend(u.cfg, &u.pins, u.onBoundEvict)
+
+	if u.cfg.MaxCost > 0 {
+		u.costs.reset()
+	}
+	max := u.maxEntries.Load()
+	for id, user := range u.db {
+		if max > 0 && int64(next.len()) >= max {
+			break
+		}
+		if u.cfg.MaxValueBytes > 0 && user.size() > u.cfg.MaxValueBytes {
+			continue
+		}
+		if u.cfg.Intern {
+			user = unique.Make(user).Value()
+		}
+		next.swap(id, user)
+		if u.cfg.MaxCost > 0 {
+			u.costs.put(id, 1, func(id int) {
+				next.delete(id)
+				u.stats.costEvicted.Add(1)
+				u.onEvict(id)
+			})
+		}
+	}
+	prev := u.cache.Swap(&cacheRef{next})
+	if c, ok := prev.cacheBackend.(backendCloser); ok {
+		c.close()
+	}
+}
+
+// GetAndDelete removes id from the cache and the db, dropping a buffered
+// Store too, and returns the newest of those values. Of several concurrent
+// calls for the same id exactly one gets the value.
+func (u *UserRepo) GetAndDelete(id int) (User, bool, error) {
+	u.writes.Add(1)
+	defer u.writes.Add(-1)
+	if u.draining.Load() {
+		return User{}, false, ErrDraining
+	}
+	if !u.ready.Load() {
+		return User{}, false, ErrNotInitialized
+	}
+
+	var pending pendingWrite
+	var buffered bool
+	if u.cfg.WriteCoalesceWindow > 0 {
+		u.coalescer.mu.Lock()
+		defer u.coalescer.mu.Unlock()
+		if pending, buffered = u.coalescer.pending[id]; buffered {
+			delete(u.coalescer.pending, id)
+		}
+	}
+
+	var stored User
+	var inDB bool
+	if !u.cfg.CacheOnly {
+		u.dbMutex.Lock()
+		defer u.dbMutex.Unlock()
+		if stored, inDB = u.db[id]; inDB {
+			delete(u.db, id)
+			delete(u.versions, id)
+			u.seq++
+		}
+	}
+
+	cached, ok := u.backend().loadAndDelete(id)
+	if ok {
+		u.forget(id)
+	}
+	switch {
+	case buffered:
+		return pending.user, true, nil
+	case ok:
+		return cached, true, nil
+	}
+	return stored, inDB, nil
+}
+
+// DeleteWhere removes every cached entry for which pred returns true and
+// returns how many were removed. pred runs over a snapshot with no lock held;
+// an entry that changed after the snapshot was taken is left alone. Only the
+// cache is affected, the db keeps its rows.
+func (u *UserRepo) DeleteWhere(pred func(id int, user User) bool) int {
+	if !u.ready.Load() {
+		return 0
+	}
+	c := u.backend()
+	n := 0
+	for id, user := range c.snapshot() {
+		if pred(id, user) && c.compareAndDelete(id, user) {
+			u.forget(id)
+			n++
+		}
+	}
+	return n
+}
+
+// HealthCheck reports readiness from a few atomic reads and the backend's
+// entry count; it never scans the cache.
+func (u *UserRepo) HealthCheck() HealthStatus {
+	h := HealthStatus{
+		Initialized: u.ready.Load(),
+		Draining:    u.draining.Load(),
+		Kind:        u.cfg.Kind,
+	}
+	if h.Initialized {
+		h.Entries = u.backend().len()
+	}
+	h.Healthy = h.Initialized && !h.Draining
+
+	return h
+}
+
+func (u *UserRepo) Cost() int64 {
+	return u.costs.cost()
+}
+
+// Seed copies users into both the db and the cache, so they are served as
+// cache hits from the first Get. The map is not retained.
+func (u *UserRepo) Seed(users map[int]User) error {
+	u.writes.Add(1)
+	defer u.writes.Add(-1)
+	if u.draining.Load() {
+		return ErrDraining
+	}
+	if !u.ready.Load() {
+		return ErrNotInitialized
+	}
+	if !u.cfg.CacheOnly {
+		u.dbMutex.Lock()
+		for id, user := range users {
+			u.putDB(id, user)
+			u.bumpVersion(id)
+		}
+		u.dbMutex.Unlock()
+	}
+
+	for id, user := range users {
+		u.storeInCache(id, user)
+		u.mirror(id, user)
+	}
+
+	return nil
+}
+
+// Drain switches the repo to read-only: further writes, from Store to
+// Increment, Seed and Merge, fail with ErrDraining and gossip from peers is
+// dropped, while Get keeps serving. It returns once the writes that were
+// already running have finished, or with ctx's error if that takes too long.
+func (u *UserRepo) Drain(ctx context.Context) error {
+	u.draining.Store(true)
+
+	for u.writes.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	return nil
+}
+
+// Increment adds delta to the stored user's Counter. The read, the db write
+// and the cache write all happen under dbMutex so concurrent increments of the
+// same id never lose an update.
+func (u *UserRepo) Increment(id int, delta int) (User, bool, error) {
+	u.writes.Add(1)
+	defer u.writes.Add(-1)
+	if u.draining.Load() {
+		return User{}, false, ErrDraining
+	}
+	if !u.ready.Load() {
+		return User{}, false, ErrNotInitialized
+	}
+	if u.cfg.WriteCoalesceWindow > 0 {
+		u.coalescer.mu.Lock()
+		defer u.coalescer.mu.Unlock()
+		if w, ok := u.coalescer.pending[id]; ok {
+			delete(u.coalescer.pending, id)
+			u.write(id, w.user, w.cost)
+		}
+	}
+
+	u.dbMutex.Lock()
+	defer u.dbMutex.Unlock()
+
+	if u.cfg.CacheOnly {
+		user, ok := u.backend().load(id)
+		if !ok {
+			return User{}, false, nil
+		}
+		user.Counter += delta
+		u.storeInCache(id, user)
+		u.mirror(id, user)
+		return user, true, nil
+	}
+
+	user, ok := u.db[id]
+	if !ok {
+		return User{}, false, nil
+	}
+	user.Counter += delta
+	u.db[id] = user
+	u.bumpVersion(id)
+	u.storeInCache(id, user)
+	u.mirror(id, user)
+
+	return user, true, nil
+}
+
+// Config returns a copy of the configuration the repo was initialized with.
+func (u *UserRepo) Config() CacheConfig {
+	u.dbMutex.Lock()
+	defer u.dbMutex.Unlock()
+	return u.cfg
+}
+
+// Pressure returns how full the cache is relative to its bounds: the larger
+// of the entry count over MaxEntries and the summed cost over MaxCost. Above
+// 1 the cache is over budget until the next eviction pass. It is 0 for an
+// unbounded cache.
+func (u *UserRepo) Pressure() float64 {
+	if !u.ready.Load() {
+		return 0
+	}
+	c := u.backend()
+	max := int(u.maxEntries.Load())
+	if r, ok := c.(backendResizer); ok && max == 0 {
+		max = r.limit()
+	}
+
+	p := 0.0
+	if max > 0 {
+		p = float64(c.len()) / float64(max)
+	}
+	if u.cfg.MaxCost > 0 {
+		p = math.Max(p, float64(u.costs.cost())/float64(u.cfg.MaxCost))
+	}
+	return p
+}
+
+// Resize changes MaxEntries at runtime. Under OverflowEvict shrinking below
+// the current entry count evicts the least recently used unpinned entries
+// down to the new bound before Resize returns. Last use is recorded only
+// while the cache is bounded, so entries not used since then go first when an
+// unbounded cache is shrunk. Stores running concurrently with Resize can
+// leave the cache a few entries over the bound until the next eviction pass,
+// which drops arbitrary entries as usual. As in Init, only the sync.Map
+// backend can be bounded under OverflowEvict. Under the other policies
+// nothing is evicted and new ids are refused until enough entries are
+// removed.
+func (u *UserRepo) Resize(maxEntries int) error {
+	if !u.ready.Load() {
+		return ErrNotInitialized
+	}
+	if maxEntries < 0 {
+		return fmt.Errorf("%w: MaxEntries %d is negative", ErrInvalidConfig, maxEntries)
+	}
+	if u.cfg.Overflow == OverflowEvict && u.cfg.Kind != CacheSyncMap {
+		return fmt.Errorf("%w: %s backend has no entry bound", ErrInvalidConfig, u.cfg.Kind)
+	}
+
+	// holding dbMutex keeps a concurrent Reload from building its backend
+	// with the old bound
+	u.dbMutex.Lock()
+	defer u.dbMutex.Unlock()
+	u.cfg.MaxEntries = maxEntries
+	if u.cfg.Overflow != OverflowEvict {
+		u.maxEntries.Store(int64(maxEntries))
+		return nil
+	}
+	if maxEntries > 0 {
+		u.trackUse.Store(true)
+	}
+	// shrinking before lowering the bound keeps the backend's own pass,
+	// which picks arbitrary entries, from running first
+	u.shrinkTo(maxEntries)
+	u.backend().(backendResizer).resize(maxEntries)
+
+	return nil
+}
+
+// shrinkTo evicts the least recently used unpinned entries until at most max
+// remain; entries with no recorded use go first. Zero means no bound.
+func (u *UserRepo) shrinkTo(max int) {
+	c := u.backend()
+	over := c.len() - max
+	if max == 0 || over <= 0 {
+		return
+	}
+
+	ids := slices.DeleteFunc(c.keys(), u.pins.has)
+	slices.SortFunc(ids, func(a, b int) int {
+		return cmp.Compare(u.idle.lastUse(a), u.idle.lastUse(b))
+	})
+	for _, id := range ids[:min(over, len(ids))] {
+		c.delete(id)
+		u.onBoundEvict(id)
+	}
+}
+
+func (u *UserRepo) Stats() Stats {
+	s := u.stats.snapshot()
+	if u.cfg.TrackLifetimes {
+		s.Lifetimes = u.lifetimes.snapshot()
+	}
+	if u.cfg.TrackHitWindows {
+		now := u.clock()
+		s.LastMinute = u.hitWindow.counts(now, time.Minute)
+		s.Last5Minutes = u.hitWindow.counts(now, 5*time.Minute)
+	}
+	return s
+}
+
+// ResetStats zeroes all counters reported by Stats without touching the
+// cache, e.g. to measure the hit ratio of one run. Operations running
+// concurrently may be partly counted.
+func (u *UserRepo) ResetStats() {
+	u.stats.reset()
+	u.lifetimes.resetHist()
+	u.hitWindow.reset()
+}
+
+func (u *UserRepo) logStats() {
+	defer u.bg.Done()
+	t := time.NewTicker(u.cfg.StatsInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-u.done:
+			return
+		case <-t.C:
+			s := u.Stats()
+			u.logger.Printf("stats: hit ratio %.2f %+v", s.HitRatio(), s)
+		}
+	}
+}
+
+// Close stops the repo's background goroutines and waits for them to exit.
+// It is safe to call more than once.
+func (u *UserRepo) Close() {
+	if !u.ready.Load() {
+		return
+	}
+	u.closeOnce.Do(func() {
+		close(u.done)
+		u.refreshes.cancelAll()
+		if c, ok := u.backend().(backendCloser); ok {
+			c.close()
+		}
+		u.bg.Wait()
+		u.flushLogs()
+	})
+	u.bg.Wait()
+}
+
+func (u *UserRepo) Init(cfg CacheConfig, logger *log.Logger) error {
+	u.cfg = cfg
+	u.logger = logger
+	u.o.Do(u.doInit)
+
+	return u.initErr
+}
+
+func (u *UserRepo) doInit() {
+	if u.initErr = u.cfg.validate(); u.initErr != nil {
+		return
+	}
+
+	u.clock = time.Now
+	u.db = make(map[int]User)
+	u.versions = make(map[int]entryVersion)
+	u.peerMarks = make(map[*UserRepo]uint64)
+	u.aggregates = make(map[string]aggregateEntry)
+	u.loads.init()
+	u.async.init(u.cfg.AsyncWorkers)
+	u.initLogShards(u.cfg.LogShards)
+	u.cache.Store(&cacheRef{newCacheBackend(u.cfg, &u.pins, u.onBoundEvict)})
+	if u.cfg.Overflow != OverflowEvict {
+		u.maxEntries.Store(int64(u.cfg.MaxEntries))
+	} else if u.cfg.MaxEntries > 0 {
+		u.trackUse.Store(true)
+	}
+	u.lifetimes.init()
+	u.costs.init(u.cfg.MaxCost, &u.pins)
+	u.coalescer.pending = make(map[int]pendingWrite)
+	u.refreshes.pending = make(map[int]*pendingRefresh)
+	u.done = make(chan struct{})
+	if u.cfg.StatsInterval > 0 {
+		u.bg.Add(1)
+		go u.logStats()
+	}
+	if u.cfg.EvictOnGC > 0 {
+		u.gcCycles = make(chan struct{}, 1)
+		u.armGCSentinel()
+		u.bg.Add(1)
+		go u.shedOnGC()
+	}
+	u.ready.Store(true)
+}
+
+type UserService struct {
+	repo    *UserRepo
+	handler OpFunc
+}
+
+func (u *UserService) Init(r *UserRepo) {
+	u.repo = r
+	u.handler = u.do
+}
+
+// Use wraps Get, Store and GetAndDelete with mw. The middleware registered last runs first
+// and the repo call is always innermost. Use is not safe to call while the
+// service is serving requests.
+func (u *UserService) Use(mw Middleware) {
+	u.handler = mw(u.handler)
+}
+
+func (u *UserService) do(op Op) (User, bool, error) {
+	switch op.Kind {
+	case OpStore:
+		return User{}, false, u.repo.Store(op.ID, op.User)
+	case OpDelete:
+		return u.repo.GetAndDelete(op.ID)
+	}
+	user, ok := u.repo.Get(op.ID)
+	return user, ok, nil
+}
+
+func (u *UserService) Get(id int) (User, bool) {
+	user, ok, _ := u.handler(Op{Kind: OpGet, ID: id})
+	return user, ok
+}
+
+func (u *UserService) GetCtx(ctx context.Context, id int) (User, bool, error) {
+	return u.repo.GetCtx(ctx, id)
+}
+
+func (u *UserService) GetWithMetadata(id int) (User, GetMetadata) {
+	return u.repo.GetWithMetadata(id)
+}
+
+func (u *UserService) Transaction(fn func(tx *Tx) error) error {
+	return u.repo.Transaction(fn)
+}
+
+func (u *UserService) Resize(maxEntries int) error {
+	return u.repo.Resize(maxEntries)
+}
+
+func (u *UserService) StoreCtx(ctx context.Context, id int, user User) error {
+	return u.repo.StoreCtx(ctx, id, user)
+}
+
+func (u *UserService) Aggregate(key string, compute func(users map[int]User) any) any {
+	return u.repo.Aggregate(key, compute)
+}
+
+func (u *UserService) MirrorTo(secondary Cache) {
+	u.repo.MirrorTo(secondary)
+}
+
+func (u *UserService) SetLoaderChain(loaders ...Loader) {
+	u.repo.SetLoaderChain(loaders...)
+}
+
+func (u *UserService) GetAndDelete(id int) (User, bool, error) {
+	return u.handler(Op{Kind: OpDelete, ID: id})
+}
+
+func (u *UserService) DBLen() int {
+	return u.repo.DBLen()
+}
+
+func (u *UserService) ResetStats() {
+	u.repo.ResetStats()
+}
+
+func (u *UserService) BeginSnapshot() *Snapshot {
+	return u.repo.BeginSnapshot()
+}
+
+func (u *UserService) TopKeys(n int) []KeyStat {
+	return u.repo.TopKeys(n)
+}
+
+func (u *UserService) Pressure() float64 {
+	return u.repo.Pressure()
+}
+
+func (u *UserService) All() iter.Seq2[int, User] {
+	return u.repo.All()
+}
+
+func (u *UserService) GetMany(ids []int) map[int]User {
+	return u.repo.GetMany(ids)
+}
+
+func (u *UserService) Merge(other *UserService, conflict ConflictPolicy) (int, error) {
+	return u.repo.Merge(other.repo, conflict)
+}
+
+func (u *UserService) GetOrDefault(id int, def User) User {
+	return u.repo.GetOrDefault(id, def)
+}
+
+func (u *UserService) GetAsync(id int) (User, bool) {
+	return u.repo.GetAsync(id)
+}
+
+func (u *UserService) GetManyPartial(ids []int) (map[int]User, []int) {
+	return u.repo.GetManyPartial(ids)
+}
+
+func (u *UserService) GetIfPresent(id int) (User, bool) {
+	return u.repo.GetIfPresent(id)
+}
+
+func (u *UserService) Increment(id int, delta int) (User, bool, error) {
+	return u.repo.Increment(id, delta)
+}
+
+func (u *UserService) Keys() []int {
+	return u.repo.Keys()
+}
+
+func (u *UserService) Config() CacheConfig {
+	return u.repo.Config()
+}
+
+func (u *UserService) Stats() Stats {
+	return u.repo.Stats()
+}
+
+func (u *UserService) Store(id int, user User) error {
+	_, _, err := u.handler(Op{Kind: OpStore, ID: id, User: user})
+	return err
+}
+
+func (u *UserService) Swap(id int, user User) (User, bool, error) {
+	return u.repo.Swap(id, user)
+}
+
+func (u *UserService) StoreWithCost(id int, user User, cost int64) error {
+	return u.repo.StoreWithCost(id, user, cost)
+}
+
+func (u *UserService) DeleteWhere(pred func(id int, user User) bool) int {
+	return u.repo.DeleteWhere(pred)
+}
+
+func (u *UserService) Invalidate(id int) {
+	u.repo.Invalidate(id)
+}
+
+func (u *UserService) Pin(id int) {
+	u.repo.Pin(id)
+}
+
+func (u *UserService) Unpin(id int) {
+	u.repo.Unpin(id)
+}
+
+func (u *UserService) Reload() {
+	u.repo.Reload()
+}
+
+func (u *UserService) HealthCheck() HealthStatus {
+	return u.repo.HealthCheck()
+}
+
+func (u *UserService) Cost() int64 {
+	return u.repo.Cost()
+}
+
+func (u *UserService) LoadUsersCSV(r io.Reader, warm bool) error {
+	return u.repo.LoadUsersCSV(r, warm)
+}
+
+func (u *UserService) Seed(users map[int]User) error {
+	return u.repo.Seed(users)
+}
+
+func (u *UserService) Close() {
+	u.repo.Close()
+}
+
+func (u *UserService) Drain(ctx context.Context) error {
+	return u.repo.Drain(ctx)
+}
+
+type UserServer struct {
+	service *UserService
+}
+
+func (u *UserServer) Init(service *UserService) {
+	u.service = service
 }
 
-type UserRepo struct {
-	o         sync.Once
-	dbMutex   sync.Mutex
-	db        map[int]User
-	isCacheSM bool
-	cacheSM   sync.Map
-	rwm       sync.RWMutex
-	cacheRWM  map[int]User
-	logger    *log.Logger
+func (u *UserServer) Use(mw Middleware) {
+	u.service.Use(mw)
 }
 
-func (u *UserRepo) getFromCache(id int) (User, bool) {
-	if u.isCacheSM {
-		user, ok := u.cacheSM.Load(id)
-		if !ok {
-			u.logger.Println(notFoundInCache)
-			return User{}, false
-		}
-		u.logger.Println(foundInCache)
-		return user.(User), true
-	}
+func (u *UserServer) Get(id int) (User, bool) {
+	return u.service.Get(id)
+}
 
-	u.rwm.RLock()
-	user, ok := u.cacheRWM[id]
-	u.rwm.RUnlock()
-	if !ok {
-		u.logger.Println(notFoundInCache)
-		return User{}, false
-	}
+func (u *UserServer) GetCtx(ctx context.Context, id int) (User, bool, error) {
+	return u.service.GetCtx(ctx, id)
+}
 
-	u.logger.Println(foundInCache)
+func (u *UserServer) GetWithMetadata(id int) (User, GetMetadata) {
+	return u.service.GetWithMetadata(id)
+}
 
-	return user, true
+func (u *UserServer) Transaction(fn func(tx *Tx) error) error {
+	return u.service.Transaction(fn)
 }
 
-func (u *UserRepo) storeInCache(id int, user User) {
-	if u.isCacheSM {
-		u.cacheSM.Store(id, user)
-		return
-	}
+func (u *UserServer) Resize(maxEntries int) error {
+	return u.service.Resize(maxEntries)
+}
 
-	u.rwm.Lock()
-	u.cacheRWM[id] = user
-	u.rwm.Unlock()
+func (u *UserServer) StoreCtx(ctx context.Context, id int, user User) error {
+	return u.service.StoreCtx(ctx, id, user)
 }
 
-func (u *UserRepo) Get(id int) (User, bool) {
-	if v, ok := u.getFromCache(id); ok {
-		return v, true
-	}
+func (u *UserServer) Aggregate(key string, compute func(users map[int]User) any) any {
+	return u.service.Aggregate(key, compute)
+}
 
-	u.dbMutex.Lock()
-	user, ok := u.db[id]
-	u.dbMutex.Unlock()
-	if !ok {
-		u.logger.Println(notFoundInDB)
-		return User{}, false
-	}
+func (u *UserServer) MirrorTo(secondary Cache) {
+	u.service.MirrorTo(secondary)
+}
 
-	u.storeInCache(id, user)
+func (u *UserServer) SetLoaderChain(loaders ...Loader) {
+	u.service.SetLoaderChain(loaders...)
+}
 
-	u.logger.Println(foundInDB)
+func (u *UserServer) GetAndDelete(id int) (User, bool, error) {
+	return u.service.GetAndDelete(id)
+}
 
-	return user, true
+func (u *UserServer) DBLen() int {
+	return u.service.DBLen()
 }
 
-func (u *UserRepo) Store(id int, user User) {
-	u.dbMutex.Lock()
-	u.db[id] = user
-	u.dbMutex.Unlock()
-	u.storeInCache(id, user)
+func (u *UserServer) ResetStats() {
+	u.service.ResetStats()
 }
 
-func (u *UserRepo) Init(isCacheSM bool, logger *log.Logger) {
-	u.isCacheSM = isCacheSM
-	u.logger = logger
-	u.o.Do(u.doInit)
+func (u *UserServer) BeginSnapshot() *Snapshot {
+	return u.service.BeginSnapshot()
 }
 
-func (u *UserRepo) doInit() {
-	u.db = make(map[int]User)
-	u.cacheRWM = make(map[int]User)
+func (u *UserServer) TopKeys(n int) []KeyStat {
+	return u.service.TopKeys(n)
 }
 
-type UserService struct {
-	repo *UserRepo
+func (u *UserServer) Pressure() float64 {
+	return u.service.Pressure()
 }
 
-func (u *UserService) Init(r *UserRepo) {
-	u.repo = r
+func (u *UserServer) All() iter.Seq2[int, User] {
+	return u.service.All()
 }
 
-func (u *UserService) Get(id int) (User, bool) {
-	return u.repo.Get(id)
+func (u *UserServer) GetMany(ids []int) map[int]User {
+	return u.service.GetMany(ids)
 }
 
-func (u *UserService) Store(id int, user User) {
-	u.repo.Store(id, user)
+func (u *UserServer) Merge(other *UserServer, conflict ConflictPolicy) (int, error) {
+	return u.service.Merge(other.service, conflict)
 }
 
-type UserServer struct {
-	service *UserService
+func (u *UserServer) GetOrDefault(id int, def User) User {
+	return u.service.GetOrDefault(id, def)
 }
 
-func (u *UserServer) Init(service *UserService) {
-	u.service = service
+func (u *UserServer) GetAsync(id int) (User, bool) {
+	return u.service.GetAsync(id)
 }
 
-func (u *UserServer) Get(id int) (User, bool) {
-	return u.service.Get(id)
+func (u *UserServer) GetManyPartial(ids []int) (map[int]User, []int) {
+	return u.service.GetManyPartial(ids)
+}
+
+func (u *UserServer) GetIfPresent(id int) (User, bool) {
+	return u.service.GetIfPresent(id)
+}
+
+func (u *UserServer) Increment(id int, delta int) (User, bool, error) {
+	return u.service.Increment(id, delta)
+}
+
+func (u *UserServer) Keys() []int {
+	return u.service.Keys()
+}
+
+func (u *UserServer) Config() CacheConfig {
+	return u.service.Config()
+}
+
+func (u *UserServer) Stats() Stats {
+	return u.service.Stats()
+}
+
+func (u *UserServer) Store(id int, user User) error {
+	return u.service.Store(id, user)
+}
+
+func (u *UserServer) Swap(id int, user User) (User, bool, error) {
+	return u.service.Swap(id, user)
+}
+
+func (u *UserServer) StoreWithCost(id int, user User, cost int64) error {
+	return u.service.StoreWithCost(id, user, cost)
+}
+
+func (u *UserServer) DeleteWhere(pred func(id int, user User) bool) int {
+	return u.service.DeleteWhere(pred)
+}
+
+func (u *UserServer) Invalidate(id int) {
+	u.service.Invalidate(id)
+}
+
+func (u *UserServer) Pin(id int) {
+	u.service.Pin(id)
+}
+
+func (u *UserServer) Unpin(id int) {
+	u.service.Unpin(id)
+}
+
+func (u *UserServer) Reload() {
+	u.service.Reload()
+}
+
+func (u *UserServer) HealthCheck() HealthStatus {
+	return u.service.HealthCheck()
+}
+
+func (u *UserServer) Cost() int64 {
+	return u.service.Cost()
+}
+
+func (u *UserServer) LoadUsersCSV(r io.Reader, warm bool) error {
+	return u.service.LoadUsersCSV(r, warm)
+}
+
+func (u *UserServer) Seed(users map[int]User) error {
+	return u.service.Seed(users)
+}
+
+func (u *UserServer) Close() {
+	u.service.Close()
+}
+
+func (u *UserServer) Drain(ctx context.Context) error {
+	return u.service.Drain(ctx)
 }
 
-func (u *UserServer) Store(id int, user User) {
-	u.service.Store(id, user)
+type AppConfig struct {
+	Cache CacheConfig
+	// LogOutput receives the app log; nil keeps it in the buffer printed by
+	// Println.
+	LogOutput io.Writer
+	// LogFlags points to the log package flags of the app log, e.g.
+	// log.LstdFlags|log.Lmicroseconds|log.LUTC, or 0 for bare lines. Nil
+	// keeps log.LstdFlags.
+	LogFlags *int
+	// LogPrefix starts every line of the app log.
+	LogPrefix string
 }
 
 type App struct {
-	o         sync.Once
-	buf       bytes.Buffer
-	logger    *log.Logger
-	UserS     UserServer
-	isCacheSM bool
+	o       sync.Once
+	buf     bytes.Buffer
+	logger  *log.Logger
+	UserS   UserServer
+	cfg     AppConfig
+	initErr error
 }
 
-func (a *App) Init(isCacheSM bool) {
-	a.isCacheSM = isCacheSM
+func (a *App) Init(cfg AppConfig) error {
+	a.cfg = cfg
 	a.o.Do(a.doInit)
+
+	return a.initErr
 }
 
 func (a *App) doInit() {
-	a.logger = log.New(&a.buf, "", log.LstdFlags)
+	var out io.Writer = &a.buf
+	if a.cfg.LogOutput != nil {
+		out = a.cfg.LogOutput
+	}
+	flags := log.LstdFlags
+	if a.cfg.LogFlags != nil {
+		flags = *a.cfg.LogFlags
+	}
+	a.logger = log.New(out, a.cfg.LogPrefix, flags)
 	userRepo := UserRepo{}
-	userRepo.Init(a.isCacheSM, a.logger)
+	if a.initErr = userRepo.Init(a.cfg.Cache, a.logger); a.initErr != nil {
+		return
+	}
 
 	userService := UserService{}
 	userService.Init(&userRepo)
@@ -164,15 +1657,52 @@ func (a *App) doInit() {
 	a.logger.Println(appIsStarted)
 }
 
+func (a *App) Close() {
+	a.UserS.Close()
+}
+
 func (a *App) Println() {
 	fmt.Println(a.buf.String())
 }
 
-func CreateApp(isCacheSM bool) *App {
+func CreateApp(kind CacheKind) (*App, error) {
+	return CreateAppWithConfig(CacheConfig{Kind: kind})
+}
+
+// MustCreateApp is CreateApp that panics on error, for the demo scenarios.
+func MustCreateApp(kind CacheKind) *App {
+	app, err := CreateApp(kind)
+	if err != nil {
+		panic(err)
+	}
+
+	return app
+}
+
+func CreateAppWithSeed(kind CacheKind, seed map[int]User) (*App, error) {
+	app, err := CreateApp(kind)
+	if err != nil {
+		return nil, err
+	}
+	if err := app.UserS.Seed(seed); err != nil {
+		app.Close()
+		return nil, err
+	}
+
+	return app, nil
+}
+
+func CreateAppWithConfig(cfg CacheConfig) (*App, error) {
+	return NewApp(AppConfig{Cache: cfg})
+}
+
+func NewApp(cfg AppConfig) (*App, error) {
 	app := App{}
-	app.Init(isCacheSM)
+	if err := app.Init(cfg); err != nil {
+		return nil, err
+	}
 
-	return &app
+	return &app, nil
 }
 
 type Scale struct {
@@ -188,6 +1718,30 @@ var mediumScale = Scale{"medium", 100000, 200, 0.9, 0.9}
 var largeScale = Scale{"large", 10000000, 5000, 0.5, 0.5}
 
 func RunScenario(app *App, scale Scale) {
+	RunScenarioWithYield(app, scale, Yield{})
+}
+
+// Yield makes every scenario goroutine pause after Every operations, to model
+// a server doing other work between cache calls rather than a spin loop.
+type Yield struct {
+	// Every is the number of operations between pauses. Zero never pauses.
+	Every int
+	// Sleep is the length of a pause. Zero yields with runtime.Gosched.
+	Sleep time.Duration
+}
+
+func (y Yield) after(op int) {
+	if y.Every == 0 || (op+1)%y.Every != 0 {
+		return
+	}
+	if y.Sleep > 0 {
+		time.Sleep(y.Sleep)
+	} else {
+		runtime.Gosched()
+	}
+}
+
+func RunScenarioWithYield(app *App, scale Scale, yield Yield) {
 	var wg sync.WaitGroup
 	wg.Add(scale.concurrency)
 
@@ -195,6 +1749,7 @@ func RunScenario(app *App, scale Scale) {
 		go func(id int) {
 			defer wg.Done()
 			for j := 0; j < scale.totalOps/scale.concurrency; j++ {
+				yield.after(j)
 				ratio := float64(j) / float64(scale.totalOps/scale.concurrency)
 				if ratio < scale.readRatio {
 					app.UserS.Get(id)
@@ -207,27 +1762,459 @@ func RunScenario(app *App, scale Scale) {
 	wg.Wait()
 }
 
-func BenchmarkScenario(name string, isCacheSM bool, scale Scale) {
-	var total time.Duration
+func timeRuns(kind CacheKind, scale Scale) []time.Duration {
+	runs := make([]time.Duration, 0, 10)
 	for i := 0; i < 10; i++ {
-		app := CreateApp(isCacheSM)
+		app := MustCreateApp(kind)
 		start := time.Now()
 		RunScenario(app, scale)
-		total += time.Since(start)
+		runs = append(runs, time.Since(start))
+		app.Close()
+	}
+	return runs
+}
+
+func average(d []time.Duration) time.Duration {
+	var total time.Duration
+	for _, v := range d {
+		total += v
+	}
+	return total / time.Duration(len(d))
+}
+
+type ScenarioResult struct {
+	// Average is the mean of Runs.
+	Average   time.Duration
+	OpsPerSec float64
+	Runs      []time.Duration
+}
+
+// RunAcrossBackends runs the same workload against every backend in
+// cacheKinds.
+func RunAcrossBackends(scale Scale) map[CacheKind]ScenarioResult {
+	results := make(map[CacheKind]ScenarioResult, len(cacheKinds))
+	for _, kind := range cacheKinds {
+		runs := timeRuns(kind, scale)
+		avg := average(runs)
+		results[kind] = ScenarioResult{Average: avg, OpsPerSec: float64(scale.totalOps) / avg.Seconds(), Runs: runs}
+	}
+	return results
+}
+
+// CalibrateBackend runs sample three times against every strict backend and
+// returns the kind with the fastest run, as a pick for workloads shaped like
+// sample. Backends serving stale reads are never picked. It takes roughly
+// 3*len(strictKinds) runs of sample, so sample should be small.
+func CalibrateBackend(sample Scale) CacheKind {
+	best, bestTime := strictKinds[0], time.Duration(math.MaxInt64)
+	for _, kind := range strictKinds {
+		for i := 0; i < 3; i++ {
+			app := MustCreateApp(kind)
+			start := time.Now()
+			RunScenario(app, sample)
+			d := time.Since(start)
+			app.Close()
+			if d < bestTime {
+				best, bestTime = kind, d
+			}
+		}
+	}
+	return best
+}
+
+// PrintResults prints one row per backend, fastest first.
+func PrintResults(name string, scale Scale, results map[CacheKind]ScenarioResult) {
+	kinds := slices.Collect(maps.Keys(results))
+	slices.SortFunc(kinds, func(a, b CacheKind) int {
+		return cmp.Compare(results[a].Average, results[b].Average)
+	})
+
+	fmt.Printf("%s (%s), average over 10 runs:\n", name, scale.name)
+	for _, kind := range kinds {
+		r := results[kind]
+		fmt.Printf("  %-12s %12v %12.0f ops/s\n", kind, r.Average, r.OpsPerSec)
+	}
+}
+
+func percentile(d []time.Duration, p float64) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+	slices.Sort(d)
+	return d[int(float64(len(d)-1)*p)]
+}
+
+// FairnessScenario floods the cache with readers and measures how long a
+// single writer waits per Store, exposing writer starvation.
+func FairnessScenario(kind CacheKind, scale Scale) {
+	fairnessScenario(kind.String(), CacheConfig{Kind: kind}, scale)
+}
+
+// LockPreferenceScenario runs FairnessScenario on the CacheRWMutex backend
+// under every LockPreference, showing what each costs readers and writers.
+func LockPreferenceScenario(scale Scale) {
+	for _, p := range []LockPreference{LockStd, LockPreferReaders, LockPreferWriters} {
+		fairnessScenario(fmt.Sprintf("%s (%s)", CacheRWMutex, p), CacheConfig{Kind: CacheRWMutex, LockPreference: p}, scale)
+	}
+}
+
+func fairnessScenario(name string, cfg CacheConfig, scale Scale) {
+	app, err := CreateAppWithConfig(cfg)
+	if err != nil {
+		panic(err)
+	}
+	defer app.Close()
+	perReader := scale.totalOps / scale.concurrency
+	writes := scale.totalOps / 100
+
+	var stop atomic.Bool
+	var ready, wg sync.WaitGroup
+	readLat := make([][]time.Duration, scale.concurrency)
+	ready.Add(scale.concurrency)
+	wg.Add(scale.concurrency)
+	for i := 0; i < scale.concurrency; i++ {
+		go func(id int) {
+			defer wg.Done()
+			lat := make([]time.Duration, 0, perReader)
+			ready.Done()
+			for !stop.Load() {
+				start := time.Now()
+				app.UserS.Get(id)
+				if len(lat) < perReader {
+					lat = append(lat, time.Since(start))
+				}
+			}
+			readLat[id] = lat
+		}(i)
+	}
+
+	ready.Wait()
+	writeLat := make([]time.Duration, 0, writes)
+	for j := 0; j < writes; j++ {
+		start := time.Now()
+		app.UserS.Store(j%scale.concurrency, User{Name: fmt.Sprintf("User-%d", j)})
+		writeLat = append(writeLat, time.Since(start))
+	}
+	stop.Store(true)
+	wg.Wait()
+
+	reads := slices.Concat(readLat...)
+	fmt.Printf("%s fairness (%s): read p50 %v p99 %v, write p50 %v p99 %v\n", name, scale.name,
+		percentile(reads, 0.5), percentile(reads, 0.99), percentile(writeLat, 0.5), percentile(writeLat, 0.99))
+}
+
+// PrintBenchmarkFormat writes every run in results as a line of Go benchmark
+// output, e.g. "BenchmarkHeavyRead/SyncMap/small-8  10000  152.3 ns/op", with
+// totalOps as the iteration count, so the runs can be fed to benchstat.
+func PrintBenchmarkFormat(w io.Writer, name string, scale Scale, results map[CacheKind]ScenarioResult) {
+	for _, kind := range cacheKinds {
+		r, ok := results[kind]
+		if !ok {
+			continue
+		}
+		bench := benchName(name) + "/" + benchName(kind.String()) + "/" + scale.name
+		for _, d := range r.Runs {
+			fmt.Fprintf(w, "Benchmark%s-%d\t%d\t%.2f ns/op\n", bench, runtime.GOMAXPROCS(0),
+				scale.totalOps, float64(d.Nanoseconds())/float64(scale.totalOps))
+		}
+	}
+}
+
+// benchName turns s into a benchmark name element: words are capitalized and
+// joined, and anything other than letters and digits is dropped.
+func benchName(s string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// YieldScenario runs the workload with and without yield and reports both
+// average run times.
+func YieldScenario(kind CacheKind, scale Scale, yield Yield) {
+	run := func(y Yield) time.Duration {
+		runs := make([]time.Duration, 0, 3)
+		for i := 0; i < 3; i++ {
+			app := MustCreateApp(kind)
+			start := time.Now()
+			RunScenarioWithYield(app, scale, y)
+			runs = append(runs, time.Since(start))
+			app.Close()
+		}
+		return average(runs)
+	}
+
+	fmt.Printf("%s yield (%s): spinning %v, yielding every %d ops %v\n", kind, scale.name,
+		run(Yield{}), yield.Every, run(yield))
+}
+
+// LogShardsScenario runs the workload with the single shared logger and with
+// one log shard per scenario goroutine, and reports how much contention on
+// the shared logger costs.
+func LogShardsScenario(kind CacheKind, scale Scale) {
+	run := func(shards int) time.Duration {
+		runs := make([]time.Duration, 0, 3)
+		for i := 0; i < 3; i++ {
+			app, err := CreateAppWithConfig(CacheConfig{Kind: kind, LogShards: shards})
+			if err != nil {
+				panic(err)
+			}
+			start := time.Now()
+			RunScenario(app, scale)
+			runs = append(runs, time.Since(start))
+			app.Close()
+		}
+		return average(runs)
+	}
+
+	shared := run(0)
+	sharded := run(scale.concurrency)
+	fmt.Printf("%s log shards (%s): shared logger %v, %d shards %v, speedup %.2fx\n", kind, scale.name,
+		shared, scale.concurrency, sharded, float64(shared)/float64(sharded))
+}
+
+type RampConfig struct {
+	Start int
+	Step  int
+	Max   int
+	// Plateau is the minimum relative throughput gain a step must bring for
+	// the ramp to keep going, e.g. 0.05 for 5%.
+	Plateau float64
+}
+
+// RampScenario raises concurrency from ramp.Start by ramp.Step, keeping the
+// per-goroutine op count of scale fixed, and stops once throughput no longer
+// improves by ramp.Plateau. It prints the series and returns the concurrency
+// with the best throughput.
+func RampScenario(kind CacheKind, scale Scale, ramp RampConfig) int {
+	perWorker := scale.totalOps / scale.concurrency
+	best, bestRate := 0, 0.0
+
+	fmt.Printf("%s ramp (%s): concurrency,ops/s\n", kind, scale.name)
+	for c := ramp.Start; c <= ramp.Max; c += ramp.Step {
+		s := Scale{scale.name, perWorker * c, c, scale.readRatio, scale.writeRatio}
+		app := MustCreateApp(kind)
+		start := time.Now()
+		RunScenario(app, s)
+		rate := float64(s.totalOps) / time.Since(start).Seconds()
+		app.Close()
+		fmt.Printf("%d,%.0f\n", c, rate)
+
+		if rate < bestRate*(1+ramp.Plateau) {
+			break
+		}
+		best, bestRate = c, rate
+	}
+	fmt.Printf("%s knee (%s): concurrency %d, %.0f ops/s\n", kind, scale.name, best, bestRate)
+
+	return best
+}
+
+// ScalingScenario reruns the workload at GOMAXPROCS 1, 2, 4, ... up to
+// NumCPU and prints the throughput at each level with its scaling efficiency,
+// the throughput relative to GOMAXPROCS=1 times the number of procs. The
+// previous GOMAXPROCS is restored afterwards.
+func ScalingScenario(kind CacheKind, scale Scale) {
+	prev := runtime.GOMAXPROCS(0)
+	defer runtime.GOMAXPROCS(prev)
+
+	var procs []int
+	for p := 1; p < runtime.NumCPU(); p *= 2 {
+		procs = append(procs, p)
+	}
+	procs = append(procs, runtime.NumCPU())
+
+	fmt.Printf("%s scaling (%s):\n  %6s %14s %10s\n", kind, scale.name, "procs", "ops/s", "efficiency")
+	var base float64
+	for _, p := range procs {
+		runtime.GOMAXPROCS(p)
+		rate := float64(scale.totalOps) / average(timeRuns(kind, scale)).Seconds()
+		if base == 0 {
+			base = rate
+		}
+		fmt.Printf("  %6d %14.0f %9.0f%%\n", p, rate, rate/(base*float64(p))*100)
+	}
+}
+
+const (
+	gcPausesMetric = "/sched/pauses/total/gc:seconds"
+	gcCPUMetric    = "/cpu/classes/gc/total:cpu-seconds"
+	totalCPUMetric = "/cpu/classes/total:cpu-seconds"
+)
+
+func readGCMetrics() []metrics.Sample {
+	samples := []metrics.Sample{{Name: gcPausesMetric}, {Name: gcCPUMetric}, {Name: totalCPUMetric}}
+	metrics.Read(samples)
+	return samples
+}
+
+// histogramQuantile returns the upper bound of the bucket holding quantile q
+// of the observations added between before and after.
+func histogramQuantile(before, after *metrics.Float64Histogram, q float64) float64 {
+	var total uint64
+	counts := make([]uint64, len(after.Counts))
+	for i := range counts {
+		counts[i] = after.Counts[i] - before.Counts[i]
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+
+	var seen uint64
+	for i, c := range counts {
+		seen += c
+		if float64(seen) >= q*float64(total) {
+			if math.IsInf(after.Buckets[i+1], 1) {
+				return after.Buckets[i]
+			}
+			return after.Buckets[i+1]
+		}
+	}
+	return after.Buckets[len(after.Buckets)-1]
+}
+
+// GCScenario runs the workload once and reports the GC pauses and the share
+// of CPU time spent in the GC while it ran.
+func GCScenario(kind CacheKind, scale Scale) {
+	app := MustCreateApp(kind)
+	defer app.Close()
+	runtime.GC()
+	before := readGCMetrics()
+	RunScenario(app, scale)
+	after := readGCMetrics()
+
+	p99 := histogramQuantile(before[0].Value.Float64Histogram(), after[0].Value.Float64Histogram(), 0.99)
+	gcCPU := after[1].Value.Float64() - before[1].Value.Float64()
+	totalCPU := after[2].Value.Float64() - before[2].Value.Float64()
+	fraction := 0.0
+	if totalCPU > 0 {
+		fraction = gcCPU / totalCPU
+	}
+
+	fmt.Printf("%s gc (%s): gc-pause p99 %v, gc cpu fraction %.2f%%\n", kind, scale.name,
+		time.Duration(p99*float64(time.Second)), fraction*100)
+}
+
+// LoggingCostScenario runs the workload with the default buffered log and
+// with logging to io.Discard, and reports how much of the run time is due to
+// logging every cache and db hit or miss.
+func LoggingCostScenario(kind CacheKind, scale Scale) {
+	run := func(out io.Writer) time.Duration {
+		var total time.Duration
+		for i := 0; i < 3; i++ {
+			app, err := NewApp(AppConfig{Cache: CacheConfig{Kind: kind}, LogOutput: out})
+			if err != nil {
+				panic(err)
+			}
+			start := time.Now()
+			RunScenario(app, scale)
+			total += time.Since(start)
+			app.Close()
+		}
+		return total / 3
+	}
+
+	on := run(nil)
+	off := run(io.Discard)
+	fmt.Printf("%s logging cost (%s): with log %v, without %v, overhead %.1f%%\n", kind, scale.name,
+		on, off, float64(on-off)/float64(off)*100)
+}
+
+// positiveInt is an int flag that rejects values below 1 as a usage error.
+type positiveInt int
+
+func (p *positiveInt) String() string {
+	return strconv.Itoa(int(*p))
+}
+
+func (p *positiveInt) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	if n <= 0 {
+		return fmt.Errorf("%d is not positive", n)
 	}
-	fmt.Printf("%s (%s) average time over 10 runs: %v\n", name, scale.name, total/10)
+	*p = positiveInt(n)
+	return nil
 }
 
 func main() {
+	procs := flag.Int("procs", 0, "GOMAXPROCS for the run (0 keeps the default)")
+	benchfmt := flag.Bool("benchfmt", false, "print the per-backend runs in Go benchmark format for benchstat")
+	var yield Yield
+	flag.IntVar(&yield.Every, "yield-every", 0, "also compare each backend against runs that pause every N ops (0 skips it)")
+	flag.DurationVar(&yield.Sleep, "yield-sleep", 0, "pause length for -yield-every (0 calls runtime.Gosched)")
+	scaling := flag.Bool("scaling", false, "rerun the medium heavy-read workload at each GOMAXPROCS up to NumCPU instead of the fixed scales")
+	ramp := flag.Bool("ramp", false, "ramp concurrency to find the throughput knee instead of the fixed scales")
+	rc := RampConfig{Start: 1, Step: 8}
+	flag.Var((*positiveInt)(&rc.Start), "ramp-start", "initial `concurrency` for -ramp")
+	flag.Var((*positiveInt)(&rc.Step), "ramp-step", "concurrency `increment` for -ramp")
+	flag.IntVar(&rc.Max, "ramp-max", 1024, "maximum concurrency for -ramp")
+	flag.Float64Var(&rc.Plateau, "ramp-plateau", 0.05, "minimum relative gain per step for -ramp")
+	flag.Parse()
+	if *procs > 0 {
+		runtime.GOMAXPROCS(*procs)
+	}
+
 	fmt.Println("Starting benchmarks...")
+	fmt.Printf("%s GOMAXPROCS=%d NumCPU=%d\n", runtime.Version(), runtime.GOMAXPROCS(0), runtime.NumCPU())
+
+	if *scaling {
+		for _, kind := range cacheKinds {
+			ScalingScenario(kind, Scale{mediumScale.name, mediumScale.totalOps, mediumScale.concurrency, 0.9, 0.1})
+		}
+		return
+	}
+
+	if *ramp {
+		for _, kind := range cacheKinds {
+			RampScenario(kind, Scale{mediumScale.name, mediumScale.totalOps, mediumScale.concurrency, 0.9, 0.1}, rc)
+		}
+		return
+	}
+
+	for _, s := range []Scale{
+		{smallScale.name, smallScale.totalOps, smallScale.concurrency, 0.9, 0.1},
+		{smallScale.name, smallScale.totalOps, smallScale.concurrency, 0.1, 0.9},
+	} {
+		fmt.Printf("calibrated backend for %.0f%% reads: %s\n", s.readRatio*100, CalibrateBackend(s))
+	}
 
 	for _, scale := range []Scale{smallScale, mediumScale, largeScale} {
 		fmt.Printf("\n--- %s scale ---\n", scale.name)
-		BenchmarkScenario("sync.Map heavy read", true, Scale{scale.name, scale.totalOps, scale.concurrency, 0.9, 0.1})
-		BenchmarkScenario("sync.Map heavy write", true, Scale{scale.name, scale.totalOps, scale.concurrency, 0.1, 0.9})
-		BenchmarkScenario("RWMutex heavy read", false, Scale{scale.name, scale.totalOps, scale.concurrency, 0.9, 0.1})
-		BenchmarkScenario("RWMutex heavy write", false, Scale{scale.name, scale.totalOps, scale.concurrency, 0.1, 0.9})
-		BenchmarkScenario("sync.Map mixed read/write", true, Scale{scale.name, scale.totalOps, scale.concurrency, 0.5, 0.5})
-		BenchmarkScenario("RWMutex mixed read/write", false, Scale{scale.name, scale.totalOps, scale.concurrency, 0.5, 0.5})
+		for _, mix := range []struct {
+			name        string
+			read, write float64
+		}{{"heavy read", 0.9, 0.1}, {"heavy write", 0.1, 0.9}, {"mixed read/write", 0.5, 0.5}} {
+			s := Scale{scale.name, scale.totalOps, scale.concurrency, mix.read, mix.write}
+			results := RunAcrossBackends(s)
+			if *benchfmt {
+				PrintBenchmarkFormat(os.Stdout, mix.name, s, results)
+			} else {
+				PrintResults(mix.name, s, results)
+			}
+		}
+		FairnessScenario(CacheSyncMap, scale)
+		LockPreferenceScenario(scale)
+		for _, kind := range cacheKinds {
+			GCScenario(kind, Scale{scale.name, scale.totalOps, scale.concurrency, 0.5, 0.5})
+			LoggingCostScenario(kind, Scale{scale.name, scale.totalOps, scale.concurrency, 0.5, 0.5})
+			LogShardsScenario(kind, Scale{scale.name, scale.totalOps, scale.concurrency, 0.5, 0.5})
+			if yield.Every > 0 {
+				YieldScenario(kind, Scale{scale.name, scale.totalOps, scale.concurrency, 0.5, 0.5}, yield)
+			}
+		}
 	}
 }
@@ -0,0 +1,2253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func newTestRepo(t *testing.T, cfg CacheConfig) *UserRepo {
+	t.Helper()
+	u := &UserRepo{}
+	if err := u.Init(cfg, log.New(io.Discard, "", 0)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(u.Close)
+	return u
+}
+
+func TestRetryBudgetBackoffOnlyIsCapped(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	var calls atomic.Int32
+	u.SetLoaderChain(func(int) (User, bool, error) {
+		calls.Add(1)
+		return User{}, false, errors.New("down")
+	})
+
+	ctx := context.WithValue(context.Background(), RetryBudgetKey, RetryBudget{Backoff: time.Millisecond})
+	if _, ok, err := u.GetCtx(ctx, 5000); ok || err != nil {
+		t.Fatalf("GetCtx = %v, %v, want a miss", ok, err)
+	}
+	if got := calls.Load(); got != defaultRetryAttempts {
+		t.Fatalf("loader called %d times, want %d", got, defaultRetryAttempts)
+	}
+}
+
+func TestRetryBudgetStopsWithCtx(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	var calls atomic.Int32
+	u.SetLoaderChain(func(int) (User, bool, error) {
+		calls.Add(1)
+		return User{}, false, errors.New("down")
+	})
+
+	u.db[1] = User{Name: "db"}
+
+	budget := RetryBudget{MaxAttempts: 1000, Backoff: 20 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	// ctx ends the retries, not the load: the db fallback still runs
+	if user, ok := u.loadCtx(ctx, 1, budget); !ok || user.Name != "db" {
+		t.Fatalf("loadCtx = %v, %v, want the db value", user, ok)
+	}
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Fatalf("load ran %v past a 50ms ctx", d)
+	}
+	if got := calls.Load(); got > 5 {
+		t.Fatalf("loader called %d times after ctx was done", got)
+	}
+}
+
+func TestLoadUsersCSVDropsStaleCache(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	if err := u.Store(1, User{Name: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.LoadUsersCSV(strings.NewReader("1,new\n"), false); err != nil {
+		t.Fatal(err)
+	}
+	if user, ok := u.Get(1); !ok || user.Name != "new" {
+		t.Fatalf("Get(1) = %v, %v, want new", user, ok)
+	}
+}
+
+func TestLoadUsersCSVRejectsBadRow(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	err := u.LoadUsersCSV(strings.NewReader("1,a\nx,b\n"), true)
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("err = %v, want one naming line 2", err)
+	}
+	if _, ok := u.Get(1); ok {
+		t.Fatal("a rejected file stored rows")
+	}
+}
+
+func TestUninitializedRepo(t *testing.T) {
+	var u UserRepo
+	if _, ok := u.Get(1); ok {
+		t.Fatal("Get hit on an uninitialized repo")
+	}
+	if found, missing := u.GetManyPartial([]int{1, 2}); len(found) != 0 || len(missing) != 2 {
+		t.Fatalf("GetManyPartial = %v, %v", found, missing)
+	}
+	if keys := u.Keys(); keys != nil {
+		t.Fatalf("Keys = %v", keys)
+	}
+	for range u.All() {
+		t.Fatal("All yielded an entry")
+	}
+	if n := u.DeleteWhere(func(int, User) bool { return true }); n != 0 {
+		t.Fatalf("DeleteWhere = %d", n)
+	}
+	u.Invalidate(1)
+	u.Reload()
+	if p := u.Pressure(); p != 0 {
+		t.Fatalf("Pressure = %v", p)
+	}
+	if s := u.BeginSnapshot(); s.Len() != 0 {
+		t.Fatalf("snapshot has %d entries", s.Len())
+	}
+	if err := u.Store(1, User{}); !errors.Is(err, ErrNotInitialized) {
+		t.Fatalf("Store error = %v", err)
+	}
+	if err := u.Seed(map[int]User{1: {}}); !errors.Is(err, ErrNotInitialized) {
+		t.Fatalf("Seed error = %v", err)
+	}
+	if err := u.LoadUsersCSV(strings.NewReader("1,a\n"), false); !errors.Is(err, ErrNotInitialized) {
+		t.Fatalf("LoadUsersCSV error = %v", err)
+	}
+	if err := u.Resize(10); !errors.Is(err, ErrNotInitialized) {
+		t.Fatalf("Resize error = %v", err)
+	}
+	// the db lock must not have been left held
+	if n := u.DBLen(); n != 0 {
+		t.Fatalf("DBLen = %d", n)
+	}
+	u.Close()
+}
+
+func TestWritesFailWhileDraining(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	if err := u.Store(1, User{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := u.Store(2, User{}); !errors.Is(err, ErrDraining) {
+		t.Errorf("Store error = %v", err)
+	}
+	if _, _, err := u.Increment(1, 5); !errors.Is(err, ErrDraining) {
+		t.Errorf("Increment error = %v", err)
+	}
+	if _, _, err := u.GetAndDelete(1); !errors.Is(err, ErrDraining) {
+		t.Errorf("GetAndDelete error = %v", err)
+	}
+	if err := u.Seed(map[int]User{2: {}}); !errors.Is(err, ErrDraining) {
+		t.Errorf("Seed error = %v", err)
+	}
+	if err := u.LoadUsersCSV(strings.NewReader("2,b\n"), false); !errors.Is(err, ErrDraining) {
+		t.Errorf("LoadUsersCSV error = %v", err)
+	}
+	if user, ok := u.Get(1); !ok || user != (User{Name: "a"}) {
+		t.Errorf("Get(1) = %v, %v after the drain", user, ok)
+	}
+}
+
+func TestTransactionKeepsItsOwnWritesUnderMaxDBEntries(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{MaxDBEntries: 2})
+	if err := u.Seed(map[int]User{10: {Name: "a"}, 11: {Name: "b"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := u.Transaction(func(tx *Tx) error {
+		tx.Store(10, User{Name: "c"})
+		tx.Store(1, User{Name: "d"})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int{10, 1} {
+		if _, ok := u.Get(id); !ok {
+			t.Errorf("id %d written by the transaction is missing", id)
+		}
+	}
+	if n := u.DBLen(); n != 2 {
+		t.Errorf("DBLen = %d, want 2", n)
+	}
+
+	err = u.Transaction(func(tx *Tx) error {
+		tx.Store(1, User{Name: "e"})
+		tx.Store(2, User{})
+		tx.Store(3, User{})
+		return nil
+	})
+	if !errors.Is(err, ErrFull) {
+		t.Fatalf("Transaction error = %v, want ErrFull", err)
+	}
+	if user, _ := u.Get(1); user.Name != "d" {
+		t.Errorf("rejected transaction changed id 1 to %v", user)
+	}
+}
+
+func TestAsyncWorkersBoundGoroutines(t *testing.T) {
+	const workers = 4
+	u := newTestRepo(t, CacheConfig{AsyncWorkers: workers, WriteCoalesceWindow: 20 * time.Millisecond})
+	u.SetLoaderChain(func(int) (User, bool, error) {
+		time.Sleep(20 * time.Millisecond)
+		return User{}, false, nil
+	})
+
+	before := runtime.NumGoroutine()
+	for id := 0; id < 500; id++ {
+		u.GetAsync(id)
+		if err := u.Store(1000+id, User{Name: "x"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := runtime.NumGoroutine() - before; n > workers {
+		t.Errorf("%d goroutines started, want at most %d", n, workers)
+	}
+	if s := u.Stats(); s.AsyncRejected == 0 {
+		t.Error("no task was rejected")
+	}
+
+	if err := u.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := u.DBLen(); n != 500 {
+		t.Errorf("DBLen = %d after the flushes, want 500", n)
+	}
+}
+
+func TestCalibrateBackendPicksStrictKind(t *testing.T) {
+	kind := CalibrateBackend(Scale{"tiny", 2000, 10, 0.1, 0.9})
+	if !slices.Contains(strictKinds, kind) {
+		t.Fatalf("CalibrateBackend picked %s, which is not a strict backend", kind)
+	}
+}
+
+// mapCache is a Cache over a plain map, for checking what a repo mirrors.
+type mapCache struct {
+	mu sync.Mutex
+	m  map[int]User
+}
+
+func (c *mapCache) Get(id int) (User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	user, ok := c.m[id]
+	return user, ok
+}
+
+func (c *mapCache) Store(id int, user User) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[int]User)
+	}
+	c.m[id] = user
+	return nil
+}
+
+func TestMergeConflictPolicies(t *testing.T) {
+	for _, tt := range []struct {
+		conflict ConflictPolicy
+		want     string
+	}{
+		{KeepMine, "mine"},
+		{TakeTheirs, "theirs"},
+		{HighestVersion, "theirs"},
+	} {
+		t.Run(tt.conflict.String(), func(t *testing.T) {
+			mine := newTestRepo(t, CacheConfig{})
+			theirs := newTestRepo(t, CacheConfig{})
+			mine.Store(1, User{Name: "mine"})
+			theirs.Store(1, User{Name: "old"})
+			theirs.Store(1, User{Name: "theirs"})
+			theirs.Store(2, User{Name: "only theirs"})
+			var mirror mapCache
+			mine.MirrorTo(&mirror)
+
+			if _, err := mine.Merge(theirs, tt.conflict); err != nil {
+				t.Fatal(err)
+			}
+			if user, _ := mine.Get(1); user.Name != tt.want {
+				t.Errorf("id 1 = %q, want %q", user.Name, tt.want)
+			}
+			if user, _ := mine.Get(2); user.Name != "only theirs" {
+				t.Errorf("id 2 = %q, want it imported", user.Name)
+			}
+			if user, _ := mirror.Get(2); user.Name != "only theirs" {
+				t.Errorf("mirror has id 2 = %q", user.Name)
+			}
+		})
+	}
+}
+
+func TestMergeWhileDraining(t *testing.T) {
+	mine := newTestRepo(t, CacheConfig{})
+	theirs := newTestRepo(t, CacheConfig{})
+	theirs.Store(1, User{})
+	mine.Drain(context.Background())
+	if n, err := mine.Merge(theirs, TakeTheirs); n != 0 || !errors.Is(err, ErrDraining) {
+		t.Fatalf("Merge = %d, %v, want ErrDraining", n, err)
+	}
+	var zero UserRepo
+	if _, err := zero.Merge(theirs, TakeTheirs); !errors.Is(err, ErrNotInitialized) {
+		t.Fatalf("Merge into an uninitialized repo = %v", err)
+	}
+}
+
+func TestRunAcrossBackendsCoversEveryKind(t *testing.T) {
+	results := RunAcrossBackends(Scale{"tiny", 500, 5, 0.5, 0.5})
+	for _, kind := range cacheKinds {
+		r, ok := results[kind]
+		if !ok {
+			t.Errorf("no result for %s", kind)
+			continue
+		}
+		if len(r.Runs) == 0 || r.Average <= 0 || r.OpsPerSec <= 0 {
+			t.Errorf("%s result %+v is empty", kind, r)
+		}
+	}
+}
+
+func TestVerifyOnGetIgnoresBufferedWrites(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{VerifyOnGet: 1, WriteCoalesceWindow: time.Hour})
+	if err := u.Store(1, User{Name: "buffered"}); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := u.Get(1); user.Name != "buffered" {
+		t.Fatalf("Get(1) = %v", user)
+	}
+	if s := u.Stats(); s.Discrepancies != 0 {
+		t.Fatalf("Discrepancies = %d for a buffered write", s.Discrepancies)
+	}
+	if _, ok := u.backend().load(1); ok {
+		t.Fatal("verification wrote the db value into the backend")
+	}
+}
+
+func TestAppLogFlagsAndPrefix(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		flags *int
+		want  *regexp.Regexp
+	}{
+		{"default", nil, regexp.MustCompile(`^app: \d{4}/\d\d/\d\d \d\d:\d\d:\d\d app is started!\n`)},
+		{"micro", ptr(log.LstdFlags | log.Lmicroseconds), regexp.MustCompile(`^app: \d{4}/\d\d/\d\d \d\d:\d\d:\d\d\.\d{6} app is started!\n`)},
+		{"none", ptr(0), regexp.MustCompile(`^app: app is started!\n`)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			app, err := NewApp(AppConfig{LogOutput: &out, LogFlags: tt.flags, LogPrefix: "app: "})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer app.Close()
+			if line := out.String(); !tt.want.MatchString(line) {
+				t.Errorf("log = %q, want it to match %s", line, tt.want)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestGossipConverges(t *testing.T) {
+	a := newTestRepo(t, CacheConfig{})
+	b := newTestRepo(t, CacheConfig{})
+	a.Store(1, User{Name: "from a"})
+	b.Store(2, User{Name: "from b"})
+	a.Store(3, User{Name: "a"})
+	b.Store(3, User{Name: "b"})
+
+	a.Gossip(b)
+	b.Gossip(a)
+
+	for id := 1; id <= 3; id++ {
+		ua, _ := a.Get(id)
+		ub, _ := b.Get(id)
+		if ua != ub {
+			t.Errorf("id %d: a has %v, b has %v", id, ua, ub)
+		}
+	}
+	if user, _ := b.Get(1); user.Name != "from a" {
+		t.Errorf("b did not get a's write, has %v", user)
+	}
+}
+
+func TestGossipUsesPeerWritePath(t *testing.T) {
+	a := newTestRepo(t, CacheConfig{})
+	a.Store(1, User{Name: "a"})
+
+	draining := newTestRepo(t, CacheConfig{})
+	if err := draining.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	a.Gossip(draining)
+	if _, ok := draining.Get(1); ok {
+		t.Error("a draining peer took a gossip write")
+	}
+
+	cacheOnly := newTestRepo(t, CacheConfig{CacheOnly: true})
+	mirror := &mapCache{}
+	cacheOnly.MirrorTo(mirror)
+	a.Gossip(cacheOnly)
+	if n := cacheOnly.DBLen(); n != 0 {
+		t.Errorf("CacheOnly peer has %d db entries", n)
+	}
+	if user, ok := cacheOnly.GetIfPresent(1); !ok || user.Name != "a" {
+		t.Errorf("CacheOnly peer cached %v, %v", user, ok)
+	}
+	if _, ok := mirror.Get(1); !ok {
+		t.Error("gossip write was not mirrored")
+	}
+}
+
+func TestGossipBreaksTiesOnCounter(t *testing.T) {
+	a := newTestRepo(t, CacheConfig{})
+	b := newTestRepo(t, CacheConfig{})
+	a.Store(1, User{Name: "x"})
+	b.Store(1, User{Name: "x"})
+	a.Increment(1, 5)
+	b.Increment(1, 7)
+
+	a.Gossip(b)
+	b.Gossip(a)
+
+	ua, _ := a.Get(1)
+	ub, _ := b.Get(1)
+	if ua != ub || ua.Counter != 7 {
+		t.Fatalf("a has %v, b has %v, want both {x 7}", ua, ub)
+	}
+}
+
+func TestInflightMapEmptyAfterColdGets(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	seed := make(map[int]User)
+	for id := 0; id < 500; id += 2 {
+		seed[id] = User{Name: "seeded"}
+	}
+	u.dbMutex.Lock()
+	maps.Copy(u.db, seed)
+	u.dbMutex.Unlock()
+
+	var wg sync.WaitGroup
+	for id := 0; id < 500; id++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u.Get(id)
+		}()
+	}
+	wg.Wait()
+
+	if n := u.loads.len(); n != 0 {
+		t.Fatalf("%d loads left in the in-flight map", n)
+	}
+	if s := u.Stats(); s.DBHits != 250 || s.DBMisses != 250 {
+		t.Fatalf("DBHits %d, DBMisses %d, want 250 each", s.DBHits, s.DBMisses)
+	}
+}
+
+func TestGetIfPresentSkipsTheDB(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	u.Store(1, User{Name: "a"})
+
+	// with the db locked, anything that touches it would block
+	u.dbMutex.Lock()
+	defer u.dbMutex.Unlock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if user, ok := u.GetIfPresent(1); !ok || user.Name != "a" {
+			t.Errorf("GetIfPresent(1) = %v, %v", user, ok)
+		}
+		if _, ok := u.GetIfPresent(2); ok {
+			t.Error("GetIfPresent(2) hit")
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("GetIfPresent waited for the db lock")
+	}
+}
+
+func TestKeysIsACopy(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	for id := 1; id <= 3; id++ {
+		u.Store(id, User{})
+	}
+	keys := u.Keys()
+	slices.Sort(keys)
+	if !slices.Equal(keys, []int{1, 2, 3}) {
+		t.Fatalf("Keys = %v", keys)
+	}
+	u.Store(4, User{})
+	if len(keys) != 3 {
+		t.Fatalf("a later Store changed the returned keys to %v", keys)
+	}
+}
+
+// loadEventually is c.load retried for a while, since the snapshot backend
+// publishes writes only every PublishInterval.
+func loadEventually(c cacheBackend, id int, want bool) (User, bool) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		user, ok := c.load(id)
+		if ok == want || time.Now().After(deadline) {
+			return user, ok
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBackends(t *testing.T) {
+	for _, kind := range cacheKinds {
+		t.Run(kind.String(), func(t *testing.T) {
+			c := newCacheBackend(CacheConfig{Kind: kind}, nil, func(int) {})
+			if cl, ok := c.(backendCloser); ok {
+				defer cl.close()
+			}
+
+			if _, ok := c.swap(1, User{Name: "a"}); ok {
+				t.Fatal("swap into an empty backend reported an old value")
+			}
+			if old, ok := c.swap(1, User{Name: "b"}); !ok || old.Name != "a" {
+				t.Fatalf("swap returned %v, %v, want a", old, ok)
+			}
+			c.swap(2, User{Name: "c"})
+			if user, ok := loadEventually(c, 1, true); !ok || user.Name != "b" {
+				t.Fatalf("load(1) = %v, %v", user, ok)
+			}
+			if n := c.len(); n != 2 {
+				t.Fatalf("len = %d", n)
+			}
+			if keys := c.keys(); len(keys) != 2 {
+				t.Fatalf("keys = %v", keys)
+			}
+			if snap := c.snapshot(); len(snap) != 2 || snap[2].Name != "c" {
+				t.Fatalf("snapshot = %v", snap)
+			}
+
+			if c.compareAndDelete(1, User{Name: "a"}) {
+				t.Fatal("compareAndDelete removed a changed entry")
+			}
+			if !c.compareAndDelete(1, User{Name: "b"}) {
+				t.Fatal("compareAndDelete kept a matching entry")
+			}
+			if user, ok := c.loadAndDelete(2); !ok || user.Name != "c" {
+				t.Fatalf("loadAndDelete(2) = %v, %v", user, ok)
+			}
+			if _, ok := c.loadAndDelete(2); ok {
+				t.Fatal("second loadAndDelete(2) found the entry")
+			}
+			c.swap(3, User{})
+			c.delete(3)
+			if _, ok := loadEventually(c, 3, false); ok {
+				t.Fatal("deleted entry still loads")
+			}
+			if n := c.len(); n != 0 {
+				t.Fatalf("len = %d after removing everything", n)
+			}
+		})
+	}
+}
+
+// BenchmarkBackendLoad compares the read path of the backends, including the
+// copy-on-write one storing *User against the value-copy ones.
+func BenchmarkBackendLoad(b *testing.B) {
+	const n = 1024
+	for _, kind := range cacheKinds {
+		b.Run(benchName(kind.String()), func(b *testing.B) {
+			c := newCacheBackend(CacheConfig{Kind: kind}, nil, func(int) {})
+			if cl, ok := c.(backendCloser); ok {
+				defer cl.close()
+			}
+			for id := 0; id < n; id++ {
+				c.swap(id, User{Name: "User"})
+			}
+			loadEventually(c, n-1, true)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					c.load(i % n)
+				}
+			})
+		})
+	}
+}
+
+// The BenchmarkTypeAssertion benchmarks isolate the cost of the user.(User)
+// assertion the sync.Map backend does on every read: the assertion alone on a
+// User and on a *User, and sync.Map reads holding User, holding *User and
+// skipping the assertion, next to a plain map read.
+
+const assertionKeys = 1024
+
+var assertionSink User
+
+func assertionMaps() (values, pointers *sync.Map, plain map[int]User) {
+	values, pointers = &sync.Map{}, &sync.Map{}
+	plain = make(map[int]User, assertionKeys)
+	for i := 0; i < assertionKeys; i++ {
+		u := User{Name: fmt.Sprintf("User-%d", i)}
+		values.Store(i, u)
+		pointers.Store(i, &u)
+		plain[i] = u
+	}
+	return values, pointers, plain
+}
+
+func BenchmarkTypeAssertionUser(b *testing.B) {
+	var boxed any = User{Name: "User"}
+	for b.Loop() {
+		assertionSink = boxed.(User)
+	}
+}
+
+func BenchmarkTypeAssertionPointer(b *testing.B) {
+	var boxed any = &User{Name: "User"}
+	for b.Loop() {
+		assertionSink = *boxed.(*User)
+	}
+}
+
+func BenchmarkTypeAssertionSyncMapUser(b *testing.B) {
+	values, _, _ := assertionMaps()
+	for i := 0; b.Loop(); i++ {
+		v, _ := values.Load(i % assertionKeys)
+		assertionSink = v.(User)
+	}
+}
+
+func BenchmarkTypeAssertionSyncMapPointer(b *testing.B) {
+	_, pointers, _ := assertionMaps()
+	for i := 0; b.Loop(); i++ {
+		v, _ := pointers.Load(i % assertionKeys)
+		assertionSink = *v.(*User)
+	}
+}
+
+func BenchmarkTypeAssertionSyncMapNone(b *testing.B) {
+	values, _, _ := assertionMaps()
+	for i := 0; b.Loop(); i++ {
+		values.Load(i % assertionKeys)
+	}
+}
+
+func BenchmarkTypeAssertionMap(b *testing.B) {
+	_, _, plain := assertionMaps()
+	for i := 0; b.Loop(); i++ {
+		assertionSink = plain[i%assertionKeys]
+	}
+}
+
+func TestIncrementConcurrent(t *testing.T) {
+	for _, cfg := range []CacheConfig{{}, {CacheOnly: true}, {WriteCoalesceWindow: time.Millisecond}} {
+		u := newTestRepo(t, cfg)
+		if err := u.Seed(map[int]User{1: {Name: "a"}}); err != nil {
+			t.Fatal(err)
+		}
+
+		const goroutines, perGoroutine = 50, 100
+		var wg sync.WaitGroup
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < perGoroutine; j++ {
+					if _, ok, err := u.Increment(1, 2); !ok || err != nil {
+						t.Errorf("Increment = %v, %v", ok, err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		if user, _ := u.Get(1); user.Counter != goroutines*perGoroutine*2 {
+			t.Errorf("%+v: Counter = %d, want %d", cfg, user.Counter, goroutines*perGoroutine*2)
+		}
+	}
+	if _, ok, _ := newTestRepo(t, CacheConfig{}).Increment(1, 1); ok {
+		t.Error("Increment of a missing id reported ok")
+	}
+}
+
+func TestVerifyOnGetRepairsDivergence(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{VerifyOnGet: 1})
+	u.Store(1, User{Name: "cached"})
+	u.dbMutex.Lock()
+	u.db[1] = User{Name: "db"}
+	u.dbMutex.Unlock()
+
+	if user, _ := u.Get(1); user.Name != "db" {
+		t.Fatalf("Get(1) = %v, want the db value", user)
+	}
+	if s := u.Stats(); s.Discrepancies != 1 {
+		t.Fatalf("Discrepancies = %d, want 1", s.Discrepancies)
+	}
+	if user, _ := u.GetIfPresent(1); user.Name != "db" {
+		t.Fatalf("cache still has %v after the repair", user)
+	}
+}
+
+func TestMaxValueBytesKeepsOversizedOutOfCache(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{MaxValueBytes: 64})
+	big := User{Name: strings.Repeat("x", 100)}
+	if err := u.Store(1, big); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := u.GetIfPresent(1); ok {
+		t.Fatal("oversized user was cached")
+	}
+	if user, ok := u.Get(1); !ok || user != big {
+		t.Fatal("oversized user is missing from the db")
+	}
+	if s := u.Stats(); s.OversizedSkipped == 0 {
+		t.Fatal("OversizedSkipped not counted")
+	}
+}
+
+func TestSecondaryServesAndPromotes(t *testing.T) {
+	l2 := &mapCache{}
+	l2.Store(1, User{Name: "l2"})
+	u := newTestRepo(t, CacheConfig{Secondary: l2})
+
+	if user, ok := u.Get(1); !ok || user.Name != "l2" {
+		t.Fatalf("Get(1) = %v, %v", user, ok)
+	}
+	if user, ok := u.GetIfPresent(1); !ok || user.Name != "l2" {
+		t.Fatal("L2 hit was not promoted into the cache")
+	}
+	if s := u.Stats(); s.L2Hits != 1 || s.DBHits != 0 {
+		t.Fatalf("L2Hits %d, DBHits %d", s.L2Hits, s.DBHits)
+	}
+}
+
+func TestCreateAppWithSeedServesFromCache(t *testing.T) {
+	app, err := CreateAppWithSeed(CacheRWMutex, map[int]User{1: {Name: "a"}, 2: {Name: "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+
+	for id, want := range map[int]string{1: "a", 2: "b"} {
+		if user, ok := app.UserS.Get(id); !ok || user.Name != want {
+			t.Errorf("Get(%d) = %v, %v", id, user, ok)
+		}
+	}
+	if s := app.UserS.Stats(); s.Hits != 2 || s.DBHits != 0 {
+		t.Fatalf("Hits %d, DBHits %d, want every Get served by the cache", s.Hits, s.DBHits)
+	}
+}
+
+func TestBypassCacheRefreshesStaleEntry(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	u.Store(1, User{Name: "stale"})
+	u.dbMutex.Lock()
+	u.db[1] = User{Name: "fresh"}
+	u.dbMutex.Unlock()
+
+	ctx := context.WithValue(context.Background(), BypassCacheKey, true)
+	if user, ok, err := u.GetCtx(ctx, 1); err != nil || !ok || user.Name != "fresh" {
+		t.Fatalf("bypassed GetCtx = %v, %v, %v", user, ok, err)
+	}
+	if user, _ := u.GetIfPresent(1); user.Name != "fresh" {
+		t.Fatalf("cache still has %v", user)
+	}
+}
+
+func TestMaxEntriesEvictsSyncMap(t *testing.T) {
+	const max = 100
+	u := newTestRepo(t, CacheConfig{Kind: CacheSyncMap, MaxEntries: max})
+	for id := 0; id < 3*max; id++ {
+		u.Store(id, User{})
+	}
+	if n := len(u.Keys()); n > max {
+		t.Fatalf("%d entries cached, want at most %d", n, max)
+	}
+	if n := u.DBLen(); n != 3*max {
+		t.Fatalf("DBLen = %d, evictions must leave the db alone", n)
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	app, err := CreateApp(CacheRWMutex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+
+	var calls []string
+	tag := func(name string) Middleware {
+		return func(next OpFunc) OpFunc {
+			return func(op Op) (User, bool, error) {
+				calls = append(calls, name+" "+op.Kind.String())
+				return next(op)
+			}
+		}
+	}
+	app.UserS.Use(tag("inner"))
+	app.UserS.Use(tag("outer"))
+
+	app.UserS.Store(1, User{Name: "a"})
+	if user, ok := app.UserS.Get(1); !ok || user.Name != "a" {
+		t.Fatalf("Get(1) = %v, %v through the middleware", user, ok)
+	}
+	want := []string{"outer store", "inner store", "outer get", "inner get"}
+	if !slices.Equal(calls, want) {
+		t.Fatalf("calls = %q, want %q", calls, want)
+	}
+}
+
+func TestCostEvictionKeepsExpensiveEntry(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{MaxCost: 20})
+	if err := u.StoreWithCost(1, User{Name: "expensive"}, 10); err != nil {
+		t.Fatal(err)
+	}
+	for id := 2; id < 50; id++ {
+		u.StoreWithCost(id, User{}, 1)
+	}
+	if _, ok := u.GetIfPresent(1); !ok {
+		t.Fatal("the high-cost entry was evicted before the cheap ones")
+	}
+	if c := u.Cost(); c > 20 {
+		t.Fatalf("Cost = %d over MaxCost", c)
+	}
+}
+
+func TestCostFollowsBoundEviction(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{Kind: CacheSyncMap, MaxEntries: 10, MaxCost: 1000})
+	for id := 0; id < 100; id++ {
+		u.Store(id, User{})
+	}
+	if n, c := len(u.Keys()), u.Cost(); c != int64(n) {
+		t.Fatalf("Cost = %d with %d entries cached", c, n)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	var zero UserRepo
+	if h := zero.HealthCheck(); h.Healthy || h.Initialized {
+		t.Fatalf("uninitialized repo reports %+v", h)
+	}
+
+	u := newTestRepo(t, CacheConfig{Kind: CacheMutex})
+	u.Store(1, User{})
+	want := HealthStatus{Healthy: true, Initialized: true, Kind: CacheMutex, Entries: 1}
+	if h := u.HealthCheck(); h != want {
+		t.Fatalf("HealthCheck = %+v, want %+v", h, want)
+	}
+
+	u.Drain(context.Background())
+	want.Healthy, want.Draining = false, true
+	if h := u.HealthCheck(); h != want {
+		t.Fatalf("HealthCheck while draining = %+v, want %+v", h, want)
+	}
+}
+
+func TestGetAsyncFillsInBackground(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	u.dbMutex.Lock()
+	u.db[1] = User{Name: "a"}
+	u.dbMutex.Unlock()
+
+	if _, ok := u.GetAsync(1); ok {
+		t.Fatal("first GetAsync hit")
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if user, ok := u.GetIfPresent(1); ok {
+			if user.Name != "a" {
+				t.Fatalf("cached %v", user)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the background load never filled the cache")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPrefixKeyCodecRoundTrip(t *testing.T) {
+	c := PrefixKeyCodec{Prefix: "user:"}
+	for _, id := range []int{0, 42, -7} {
+		key := c.Encode(id)
+		if !strings.HasPrefix(key, "user:") {
+			t.Errorf("Encode(%d) = %q lacks the prefix", id, key)
+		}
+		if got, err := c.Decode(key); err != nil || got != id {
+			t.Errorf("Decode(%q) = %d, %v", key, got, err)
+		}
+	}
+	if _, err := c.Decode("order:1"); err == nil {
+		t.Error("Decode accepted a key from another namespace")
+	}
+}
+
+func TestCacheOnlyLeavesDBEmpty(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{CacheOnly: true})
+	u.Store(1, User{Name: "a"})
+	u.Store(2, User{Name: "b"})
+	if n := u.DBLen(); n != 0 {
+		t.Fatalf("DBLen = %d in CacheOnly mode", n)
+	}
+	if user, ok := u.Get(1); !ok || user.Name != "a" {
+		t.Fatalf("Get(1) = %v, %v", user, ok)
+	}
+
+	if _, ok, _ := u.GetAndDelete(1); !ok {
+		t.Fatal("GetAndDelete(1) missed")
+	}
+	u.Invalidate(2)
+	for _, id := range []int{1, 2} {
+		if _, ok := u.Get(id); ok {
+			t.Errorf("removed id %d came back", id)
+		}
+	}
+}
+
+func TestStatsIntervalLogsUntilClose(t *testing.T) {
+	var out syncBuffer
+	u := &UserRepo{}
+	if err := u.Init(CacheConfig{StatsInterval: time.Millisecond}, log.New(&out, "", 0)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	u.Close()
+	logged := out.String()
+	if !strings.Contains(logged, "stats: hit ratio") {
+		t.Fatalf("no stats line in %q", logged)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if out.String() != logged {
+		t.Fatal("stats were logged after Close")
+	}
+}
+
+// syncBuffer is a strings.Builder safe for a logger writing from another
+// goroutine.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestGetOrDefault(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	def := User{Name: "default"}
+	u.Store(1, User{Name: "cached"})
+	u.dbMutex.Lock()
+	u.db[2] = User{Name: "db"}
+	u.dbMutex.Unlock()
+
+	for id, want := range map[int]string{1: "cached", 2: "db", 3: "default"} {
+		if user := u.GetOrDefault(id, def); user.Name != want {
+			t.Errorf("GetOrDefault(%d) = %v, want %s", id, user, want)
+		}
+	}
+	if _, ok := u.Get(3); ok {
+		t.Error("the default was stored")
+	}
+}
+
+func TestInternSharesEqualValues(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{Intern: true})
+	// built at run time so the two names do not share a constant's storage
+	u.Store(1, User{Name: strings.Repeat("shared", 10)})
+	u.Store(2, User{Name: strings.Repeat("shared", 10)})
+
+	a, _ := u.GetIfPresent(1)
+	b, _ := u.GetIfPresent(2)
+	if unsafe.StringData(a.Name) != unsafe.StringData(b.Name) {
+		t.Fatal("equal cached users do not share their Name storage")
+	}
+}
+
+func TestSwapReturnsPrevious(t *testing.T) {
+	for _, cfg := range []CacheConfig{{}, {CacheOnly: true}} {
+		u := newTestRepo(t, cfg)
+		if old, ok, err := u.Swap(1, User{Name: "a"}); ok || err != nil || old != (User{}) {
+			t.Errorf("%+v: first Swap = %v, %v, %v", cfg, old, ok, err)
+		}
+		if old, ok, err := u.Swap(1, User{Name: "b"}); !ok || err != nil || old.Name != "a" {
+			t.Errorf("%+v: second Swap = %v, %v, %v", cfg, old, ok, err)
+		}
+		if user, _ := u.Get(1); user.Name != "b" {
+			t.Errorf("%+v: Get(1) = %v after Swap", cfg, user)
+		}
+	}
+}
+
+func TestWriteCoalescingCollapsesBursts(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{WriteCoalesceWindow: 50 * time.Millisecond})
+	for i := 0; i < 100; i++ {
+		if err := u.Store(1, User{Counter: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if user, _ := u.Get(1); user.Counter != 99 {
+		t.Fatalf("Get(1) = %v before the flush, want the last write", user)
+	}
+	if err := u.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	u.dbMutex.Lock()
+	writes, user := u.versions[1].version, u.db[1]
+	u.dbMutex.Unlock()
+	if writes > 2 {
+		t.Errorf("db written %d times for one burst", writes)
+	}
+	if user.Counter != 99 {
+		t.Errorf("db has %v, want the last write", user)
+	}
+}
+
+func TestReloadPicksUpDBChanges(t *testing.T) {
+	for _, kind := range cacheKinds {
+		u := newTestRepo(t, CacheConfig{Kind: kind, PublishInterval: time.Millisecond})
+		u.Store(1, User{Name: "old"})
+		u.Store(2, User{Name: "gone"})
+		u.dbMutex.Lock()
+		u.db[1] = User{Name: "new"}
+		delete(u.db, 2)
+		u.db[3] = User{Name: "added"}
+		u.dbMutex.Unlock()
+
+		u.Reload()
+
+		want := map[int]User{1: {Name: "new"}, 3: {Name: "added"}}
+		if got := maps.Collect(u.All()); !maps.Equal(got, want) {
+			t.Errorf("%s: cache after Reload = %v, want %v", kind, got, want)
+		}
+	}
+}
+
+func TestPinnedEntrySurvivesEviction(t *testing.T) {
+	const max = 50
+	u := newTestRepo(t, CacheConfig{Kind: CacheSyncMap, MaxEntries: max})
+	u.Pin(0)
+	for id := 0; id < 10*max; id++ {
+		u.Store(id, User{})
+	}
+	if _, ok := u.GetIfPresent(0); !ok {
+		t.Fatal("pinned entry was evicted")
+	}
+	if n := len(u.Keys()); n > max {
+		t.Fatalf("%d entries cached, want at most %d", n, max)
+	}
+
+	u.Unpin(0)
+	for id := 10 * max; id < 20*max; id++ {
+		u.Store(id, User{})
+	}
+	if n := len(u.Keys()); n > max {
+		t.Fatalf("%d entries cached after Unpin", n)
+	}
+}
+
+func TestDebouncedInvalidateReloadsOnce(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{InvalidateDebounce: 20 * time.Millisecond})
+	u.Store(1, User{Name: "old"})
+	u.dbMutex.Lock()
+	u.db[1] = User{Name: "new"}
+	u.dbMutex.Unlock()
+
+	for i := 0; i < 10; i++ {
+		u.Invalidate(1)
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if s := u.Stats(); s.DBHits != 1 {
+		t.Fatalf("DBHits = %d, want a single reload", s.DBHits)
+	}
+	if user, _ := u.GetIfPresent(1); user.Name != "new" {
+		t.Fatalf("cache has %v after the refresh", user)
+	}
+}
+
+func TestConfigReturnsInitConfig(t *testing.T) {
+	cfg := CacheConfig{Kind: CacheSyncMap, MaxEntries: 10, TTI: time.Minute, VerifyOnGet: 0.5}
+	u := newTestRepo(t, cfg)
+	got := u.Config()
+	// CacheConfig holds funcs and an interface, so compare what was set
+	if got.Kind != cfg.Kind || got.MaxEntries != cfg.MaxEntries || got.TTI != cfg.TTI || got.VerifyOnGet != cfg.VerifyOnGet {
+		t.Fatalf("Config = %+v, want %+v", got, cfg)
+	}
+	u.Resize(20)
+	if got := u.Config(); got.MaxEntries != 20 {
+		t.Fatalf("Config().MaxEntries = %d after Resize", got.MaxEntries)
+	}
+}
+
+func TestEvictOnGCShedsEntries(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{EvictOnGC: 0.5})
+	for id := 0; id < 1000; id++ {
+		u.Store(id, User{})
+	}
+
+	// best effort: the shedding runs in the background after a GC cycle
+	deadline := time.Now().Add(2 * time.Second)
+	for u.Stats().GCEvicted == 0 && time.Now().Before(deadline) {
+		runtime.GC()
+		time.Sleep(5 * time.Millisecond)
+	}
+	if s := u.Stats(); s.GCEvicted == 0 {
+		t.Fatal("no entry was shed after GC")
+	}
+	if n := len(u.Keys()); n >= 1000 {
+		t.Fatalf("%d entries still cached", n)
+	}
+}
+
+func TestInitRejectsInvalidConfig(t *testing.T) {
+	for _, cfg := range []CacheConfig{
+		{Kind: CacheKind(99)},
+		{VerifyOnGet: 2},
+		{MaxEntries: -1},
+		{TTI: -time.Second},
+		{Overflow: OverflowPolicy(9)},
+		{Kind: CacheRWMutex, MaxEntries: 10},
+	} {
+		u := &UserRepo{}
+		if err := u.Init(cfg, log.New(io.Discard, "", 0)); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("Init(%+v) = %v, want ErrInvalidConfig", cfg, err)
+		}
+		if err := u.Store(1, User{}); !errors.Is(err, ErrNotInitialized) {
+			t.Errorf("Store after a failed Init = %v", err)
+		}
+	}
+	if _, err := CreateAppWithConfig(CacheConfig{Kind: CacheKind(99)}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("CreateAppWithConfig error = %v", err)
+	}
+}
+
+func TestSnapshotBackendStalenessIsBounded(t *testing.T) {
+	const interval = 5 * time.Millisecond
+	u := newTestRepo(t, CacheConfig{Kind: CacheSnapshot, PublishInterval: interval})
+	u.Store(1, User{Name: "a"})
+	start := time.Now()
+	for {
+		if user, ok := u.backend().load(1); ok && user.Name == "a" {
+			break
+		}
+		if time.Since(start) > 50*interval {
+			t.Fatal("write never published")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// BenchmarkHeavyRead runs the heavy-read mix of main on every backend.
+func BenchmarkHeavyRead(b *testing.B) {
+	scale := Scale{"bench", 10000, 50, 0.9, 0.1}
+	for _, kind := range cacheKinds {
+		b.Run(benchName(kind.String()), func(b *testing.B) {
+			for b.Loop() {
+				app := MustCreateApp(kind)
+				RunScenario(app, scale)
+				app.Close()
+			}
+		})
+	}
+}
+
+func TestLifetimeHistogramRecords(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{TrackLifetimes: true})
+	for id := 0; id < 5; id++ {
+		u.Store(id, User{})
+	}
+	u.Store(0, User{Name: "overwrite"})
+	u.Invalidate(1)
+	u.DeleteWhere(func(id int, _ User) bool { return id == 2 })
+
+	var samples uint64
+	for _, n := range u.Stats().Lifetimes {
+		samples += n
+	}
+	if samples != 3 {
+		t.Fatalf("%d lifetimes recorded, want 3", samples)
+	}
+}
+
+func TestDeleteWhereByPrefix(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	for id, name := range map[int]string{1: "tmp-a", 2: "keep", 3: "tmp-b", 4: "other"} {
+		u.Store(id, User{Name: name})
+	}
+	n := u.DeleteWhere(func(_ int, user User) bool {
+		return strings.HasPrefix(user.Name, "tmp-")
+	})
+	if n != 2 {
+		t.Fatalf("DeleteWhere removed %d, want 2", n)
+	}
+	keys := u.Keys()
+	slices.Sort(keys)
+	if !slices.Equal(keys, []int{2, 4}) {
+		t.Fatalf("cached ids = %v, want [2 4]", keys)
+	}
+	if n := u.DBLen(); n != 4 {
+		t.Fatalf("DBLen = %d, the db must keep its rows", n)
+	}
+}
+
+func TestGetManyPartialSplits(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	u.Store(1, User{Name: "a"})
+	u.Store(3, User{Name: "c"})
+	u.dbMutex.Lock()
+	u.db[2] = User{Name: "db only"}
+	u.dbMutex.Unlock()
+
+	found, missing := u.GetManyPartial([]int{1, 2, 3, 4})
+	if want := map[int]User{1: {Name: "a"}, 3: {Name: "c"}}; !maps.Equal(found, want) {
+		t.Errorf("found = %v, want %v", found, want)
+	}
+	if !slices.Equal(missing, []int{2, 4}) {
+		t.Errorf("missing = %v, want [2 4]", missing)
+	}
+	if s := u.Stats(); s.DBHits+s.DBMisses != 0 {
+		t.Error("GetManyPartial went to the db")
+	}
+}
+
+// BenchmarkGetLogging compares cache hits logging to a buffer, as main does,
+// with logging to io.Discard.
+func BenchmarkGetLogging(b *testing.B) {
+	for _, out := range []struct {
+		name string
+		w    io.Writer
+	}{{"Buffer", &bytes.Buffer{}}, {"Discard", io.Discard}} {
+		for _, kind := range cacheKinds {
+			b.Run(out.name+"/"+benchName(kind.String()), func(b *testing.B) {
+				app, err := NewApp(AppConfig{Cache: CacheConfig{Kind: kind}, LogOutput: out.w})
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer app.Close()
+				app.UserS.Store(1, User{})
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						app.UserS.Get(1)
+					}
+				})
+			})
+		}
+	}
+}
+
+// fakeClock is a settable clock for UserRepo.clock.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1_000_000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestTTIExpiresOnlyIdleEntries(t *testing.T) {
+	clock := newFakeClock()
+	u := newTestRepo(t, CacheConfig{TTI: time.Minute})
+	u.clock = clock.Now
+	u.Store(1, User{Name: "busy"})
+	u.Store(2, User{Name: "idle"})
+
+	for i := 0; i < 5; i++ {
+		clock.Advance(30 * time.Second)
+		if _, ok := u.GetIfPresent(1); !ok {
+			t.Fatalf("busy entry expired after %d reads", i)
+		}
+	}
+	if _, ok := u.GetIfPresent(2); ok {
+		t.Fatal("idle entry did not expire")
+	}
+}
+
+func TestGetWithMetadataMissReasons(t *testing.T) {
+	clock := newFakeClock()
+	u := newTestRepo(t, CacheConfig{TTI: time.Minute})
+	u.clock = clock.Now
+	u.Store(1, User{Name: "a"})
+	u.dbMutex.Lock()
+	u.db[2] = User{Name: "b"}
+	u.dbMutex.Unlock()
+
+	check := func(id int, want GetMetadata) {
+		t.Helper()
+		if _, md := u.GetWithMetadata(id); md != want {
+			t.Errorf("GetWithMetadata(%d) = %+v, want %+v", id, md, want)
+		}
+	}
+	check(1, GetMetadata{Found: true, CacheHit: true})
+	check(2, GetMetadata{Found: true, MissReason: MissCold})
+	check(3, GetMetadata{MissReason: MissNotInDB})
+	clock.Advance(2 * time.Minute)
+	check(1, GetMetadata{Found: true, MissReason: MissExpired})
+
+	if s := u.Stats(); s.ColdMisses != 2 || s.ExpiredMisses != 1 {
+		t.Errorf("ColdMisses %d, ExpiredMisses %d", s.ColdMisses, s.ExpiredMisses)
+	}
+}
+
+func TestGetWithMetadataVerifiesHits(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{VerifyOnGet: 1})
+	u.Store(1, User{Name: "cached"})
+	u.dbMutex.Lock()
+	u.db[1] = User{Name: "db"}
+	u.dbMutex.Unlock()
+
+	if user, md := u.GetWithMetadata(1); user.Name != "db" || !md.CacheHit {
+		t.Fatalf("GetWithMetadata = %v, %+v, want the db value", user, md)
+	}
+	if d := u.Stats().Discrepancies; d != 1 {
+		t.Fatalf("Discrepancies = %d, want 1", d)
+	}
+}
+
+func TestTransactionErrorAppliesNothing(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	u.Store(1, User{Name: "a"})
+	errAbort := errors.New("abort")
+
+	err := u.Transaction(func(tx *Tx) error {
+		tx.Store(1, User{Name: "changed"})
+		tx.Store(2, User{Name: "new"})
+		if user, _ := tx.Get(1); user.Name != "changed" {
+			t.Errorf("tx does not see its own write, got %v", user)
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("Transaction error = %v", err)
+	}
+	if user, _ := u.Get(1); user.Name != "a" {
+		t.Errorf("Get(1) = %v after a failed transaction", user)
+	}
+	if _, ok := u.Get(2); ok {
+		t.Error("id 2 was stored by a failed transaction")
+	}
+
+	err = u.Transaction(func(tx *Tx) error {
+		tx.Delete(1)
+		tx.Store(2, User{Name: "new"})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := u.Get(1); ok {
+		t.Error("id 1 survived its delete")
+	}
+	if user, _ := u.Get(2); user.Name != "new" {
+		t.Errorf("Get(2) = %v", user)
+	}
+}
+
+func TestResizeShrinksCache(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{Kind: CacheSyncMap, MaxEntries: 1000})
+	clock := newFakeClock()
+	u.clock = clock.Now
+	for id := 0; id < 500; id++ {
+		u.Store(id, User{})
+	}
+	// the oldest stores become the most recently used entries
+	clock.Advance(time.Second)
+	for id := 0; id < 100; id++ {
+		u.Get(id)
+	}
+	if err := u.Resize(100); err != nil {
+		t.Fatal(err)
+	}
+	keys := u.Keys()
+	slices.Sort(keys)
+	if len(keys) != 100 || keys[0] != 0 || keys[99] != 99 {
+		t.Fatalf("Resize(100) kept %d entries, %v..., want ids 0 to 99", len(keys), keys[:min(len(keys), 5)])
+	}
+	if err := u.Resize(-1); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("Resize(-1) = %v", err)
+	}
+	if err := newTestRepo(t, CacheConfig{Kind: CacheRWMutex}).Resize(10); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("Resize of an unbounded backend = %v", err)
+	}
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	const max = 10
+	fill := func(t *testing.T, u *UserRepo) {
+		t.Helper()
+		for id := 0; id < max; id++ {
+			if err := u.Store(id, User{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	t.Run("evict", func(t *testing.T) {
+		u := newTestRepo(t, CacheConfig{Kind: CacheSyncMap, MaxEntries: max})
+		fill(t, u)
+		if err := u.Store(max, User{}); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(u.Keys()); n > max {
+			t.Fatalf("%d entries cached", n)
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		u := newTestRepo(t, CacheConfig{Kind: CacheRWMutex, MaxEntries: max, Overflow: OverflowReject})
+		fill(t, u)
+		if err := u.Store(max, User{}); !errors.Is(err, ErrFull) {
+			t.Fatalf("Store of a new id = %v, want ErrFull", err)
+		}
+		if err := u.Store(0, User{Name: "overwrite"}); err != nil {
+			t.Fatalf("overwrite on a full cache = %v", err)
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		u := newTestRepo(t, CacheConfig{Kind: CacheRWMutex, MaxEntries: max, Overflow: OverflowBlock})
+		fill(t, u)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := u.StoreCtx(ctx, max, User{}); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("blocked StoreCtx = %v, want DeadlineExceeded", err)
+		}
+
+		done := make(chan error)
+		go func() { done <- u.StoreCtx(context.Background(), max, User{}) }()
+		time.Sleep(5 * time.Millisecond)
+		u.Invalidate(0)
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("StoreCtx stayed blocked after an entry was removed")
+		}
+	})
+}
+
+func TestPrintBenchmarkFormatParses(t *testing.T) {
+	scale := Scale{"small", 1000, 10, 0.9, 0.1}
+	results := map[CacheKind]ScenarioResult{
+		CacheSyncMap: {Runs: []time.Duration{time.Millisecond, 2 * time.Millisecond}},
+		CacheCOW:     {Runs: []time.Duration{3 * time.Millisecond}},
+	}
+	var out strings.Builder
+	PrintBenchmarkFormat(&out, "heavy read", scale, results)
+
+	line := regexp.MustCompile(`^Benchmark[A-Za-z0-9]+(/[A-Za-z0-9]+)+-\d+\t\d+\t\d+\.\d+ ns/op$`)
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("%d lines, want one per run:\n%s", len(lines), out.String())
+	}
+	for _, l := range lines {
+		if !line.MatchString(l) {
+			t.Errorf("%q is not a benchmark line", l)
+		}
+	}
+	if want := "BenchmarkHeavyRead/SyncMap/small-"; !strings.HasPrefix(lines[0], want) {
+		t.Errorf("first line %q, want prefix %q", lines[0], want)
+	}
+	if !strings.HasSuffix(lines[0], "\t1000\t1000.00 ns/op") {
+		t.Errorf("first line %q, want 1ms over 1000 ops", lines[0])
+	}
+}
+
+// BenchmarkYield compares a mixed workload run as a spin loop with the same
+// workload yielding every 100 operations.
+func BenchmarkYield(b *testing.B) {
+	scale := Scale{"bench", 10000, 50, 0.5, 0.5}
+	for _, y := range []struct {
+		name  string
+		yield Yield
+	}{{"NoYield", Yield{}}, {"Gosched", Yield{Every: 100}}, {"Sleep", Yield{Every: 100, Sleep: 10 * time.Microsecond}}} {
+		b.Run(y.name, func(b *testing.B) {
+			for b.Loop() {
+				app := MustCreateApp(CacheRWMutex)
+				RunScenarioWithYield(app, scale, y.yield)
+				app.Close()
+			}
+		})
+	}
+}
+
+func TestAggregateRecomputesAfterWrite(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	u.Store(1, User{Name: "a"})
+	u.Store(2, User{Name: "b"})
+	computed := 0
+	count := func(users map[int]User) any {
+		computed++
+		return len(users)
+	}
+
+	if n := u.Aggregate("count", count); n != 2 {
+		t.Fatalf("count = %v", n)
+	}
+	u.Get(1)
+	if n := u.Aggregate("count", count); n != 2 || computed != 1 {
+		t.Fatalf("count = %v after %d computations, want the cached result", n, computed)
+	}
+	u.Store(3, User{})
+	if n := u.Aggregate("count", count); n != 3 || computed != 2 {
+		t.Fatalf("count = %v after %d computations, want a recomputed 3", n, computed)
+	}
+}
+
+func TestMirrorToCopiesWrites(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	var secondary mapCache
+	u.MirrorTo(&secondary)
+	u.Store(1, User{Name: "a"})
+	u.Store(2, User{Name: "b"})
+	u.Store(1, User{Name: "c"})
+	u.Increment(2, 3)
+
+	if got := maps.Collect(u.All()); !maps.Equal(got, secondary.m) {
+		t.Fatalf("secondary = %v, want %v", secondary.m, got)
+	}
+
+	u.MirrorTo(nil)
+	u.Store(3, User{})
+	if _, ok := secondary.Get(3); ok {
+		t.Fatal("write mirrored after MirrorTo(nil)")
+	}
+}
+
+func TestLoaderChainRunsAfterCtxIsDone(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	u.SetLoaderChain(
+		func(int) (User, bool, error) {
+			return User{}, false, errors.New("down")
+		},
+		func(int) (User, bool, error) {
+			return User{Name: "second"}, true, nil
+		},
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	budget := RetryBudget{MaxAttempts: 10, Backoff: time.Millisecond}
+	if user, ok, stop := u.loadFromChain(ctx, 1, budget); !ok || stop || user.Name != "second" {
+		t.Fatalf("loadFromChain = %v, %v, %v, want the second loader's value", user, ok, stop)
+	}
+}
+
+func TestLoaderChainFallsThrough(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	var tried []string
+	u.SetLoaderChain(
+		func(int) (User, bool, error) {
+			tried = append(tried, "first")
+			return User{}, false, nil
+		},
+		func(id int) (User, bool, error) {
+			tried = append(tried, "second")
+			return User{Name: "from second"}, true, nil
+		},
+	)
+
+	if user, ok := u.Get(1); !ok || user.Name != "from second" {
+		t.Fatalf("Get(1) = %v, %v", user, ok)
+	}
+	if !slices.Equal(tried, []string{"first", "second"}) {
+		t.Fatalf("loaders tried: %v", tried)
+	}
+	if _, ok := u.GetIfPresent(1); !ok {
+		t.Fatal("loaded user was not cached")
+	}
+	if s := u.Stats(); s.DBHits+s.DBMisses != 0 {
+		t.Fatal("the db was consulted after a loader found the user")
+	}
+}
+
+func TestHitWindowsFollowRecentActivity(t *testing.T) {
+	clock := newFakeClock()
+	u := newTestRepo(t, CacheConfig{TrackHitWindows: true})
+	u.clock = clock.Now
+	u.Store(1, User{})
+
+	for i := 0; i < 10; i++ {
+		u.Get(2)
+	}
+	clock.Advance(2 * time.Minute)
+	for i := 0; i < 10; i++ {
+		u.Get(1)
+	}
+
+	s := u.Stats()
+	if r := s.LastMinute.HitRatio(); r != 1 {
+		t.Errorf("last minute ratio = %v, want only the recent hits", r)
+	}
+	if r := s.Last5Minutes.HitRatio(); r != 0.5 {
+		t.Errorf("last 5 minutes ratio = %v, want 0.5", r)
+	}
+	clock.Advance(10 * time.Minute)
+	if s := u.Stats(); s.Last5Minutes != (WindowCounts{}) {
+		t.Errorf("old buckets still counted: %+v", s.Last5Minutes)
+	}
+}
+
+func TestGetAndDeleteExactlyOnce(t *testing.T) {
+	for _, cfg := range []CacheConfig{{}, {Kind: CacheSyncMap}, {CacheOnly: true}, {WriteCoalesceWindow: time.Hour}} {
+		u := newTestRepo(t, cfg)
+		u.Store(1, User{Name: "a"})
+
+		var winners atomic.Int32
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if user, ok, err := u.GetAndDelete(1); err == nil && ok {
+					if user.Name != "a" {
+						t.Errorf("GetAndDelete returned %v", user)
+					}
+					winners.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if n := winners.Load(); n != 1 {
+			t.Errorf("%+v: %d callers got the value, want 1", cfg, n)
+		}
+		if _, ok := u.Get(1); ok {
+			t.Errorf("%+v: id 1 is still there", cfg)
+		}
+	}
+}
+
+func TestMaxDBEntriesBoundsTheDB(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{MaxDBEntries: 50})
+	for id := 0; id < 500; id++ {
+		if err := u.Store(id, User{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := u.DBLen(); n != 50 {
+		t.Fatalf("DBLen = %d, want 50", n)
+	}
+	if s := u.Stats(); s.DBEvicted != 450 {
+		t.Fatalf("DBEvicted = %d, want 450", s.DBEvicted)
+	}
+	if n := len(u.Keys()); n > 50 {
+		t.Fatalf("%d cached entries outlived their db rows", n)
+	}
+}
+
+func TestGetCtxWaiterGivesUpWhileLoadSucceeds(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	release := make(chan struct{})
+	u.SetLoaderChain(func(int) (User, bool, error) {
+		<-release
+		return User{Name: "slow"}, true, nil
+	})
+
+	leader := make(chan User)
+	go func() {
+		user, _, _ := u.GetCtx(context.Background(), 1)
+		leader <- user
+	}()
+	time.Sleep(5 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if _, _, err := u.GetCtx(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("waiter error = %v, want DeadlineExceeded", err)
+	}
+
+	close(release)
+	if user := <-leader; user.Name != "slow" {
+		t.Fatalf("leader got %v", user)
+	}
+	if user, ok := u.GetIfPresent(1); !ok || user.Name != "slow" {
+		t.Fatal("the shared load did not fill the cache")
+	}
+}
+
+func TestGetJoiningTimedOutGetCtxStillLoads(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	u.db[1] = User{Name: "db"}
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	u.SetLoaderChain(
+		func(int) (User, bool, error) {
+			once.Do(func() { close(started) })
+			<-release
+			return User{}, false, nil
+		},
+		func(int) (User, bool, error) {
+			return User{}, false, nil
+		},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	leader := make(chan error)
+	go func() {
+		_, _, err := u.GetCtx(ctx, 1)
+		leader <- err
+	}()
+	<-started
+
+	joined := make(chan User)
+	go func() {
+		user, _ := u.Get(1)
+		joined <- user
+	}()
+	if err := <-leader; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GetCtx error = %v, want DeadlineExceeded", err)
+	}
+
+	close(release)
+	if user := <-joined; user.Name != "db" {
+		t.Fatalf("Get joining the timed out load = %v, want the db value", user)
+	}
+}
+
+func TestResetStatsKeepsCache(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{TrackHitWindows: true})
+	u.Store(1, User{})
+	u.Get(1)
+	u.Get(2)
+
+	u.ResetStats()
+	if s := u.Stats(); s.Hits != 0 || s.Misses != 0 || s.DBMisses != 0 || s.LastMinute != (WindowCounts{}) {
+		t.Fatalf("Stats after reset = %+v", s)
+	}
+	u.Get(1)
+	if s := u.Stats(); s.Hits != 1 {
+		t.Fatalf("Hits = %d, want the cache intact and counting afresh", s.Hits)
+	}
+}
+
+func TestAuthorizeDeniesBeforeTheDB(t *testing.T) {
+	errDenied := errors.New("denied")
+	u := newTestRepo(t, CacheConfig{Authorize: func(_ context.Context, id int) error {
+		if id < 0 {
+			return errDenied
+		}
+		return nil
+	}})
+
+	if _, _, err := u.GetCtx(context.Background(), -1); !errors.Is(err, errDenied) {
+		t.Errorf("GetCtx(-1) = %v", err)
+	}
+	if err := u.StoreCtx(context.Background(), -1, User{}); !errors.Is(err, errDenied) {
+		t.Errorf("StoreCtx(-1) = %v", err)
+	}
+	if s := u.Stats(); s.DBHits+s.DBMisses+s.Misses != 0 || u.DBLen() != 0 {
+		t.Errorf("denied calls reached the cache or the db: %+v", s)
+	}
+	if err := u.StoreCtx(context.Background(), 1, User{}); err != nil {
+		t.Errorf("StoreCtx(1) = %v", err)
+	}
+}
+
+func TestSnapshotIsIsolated(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	u.Store(1, User{Name: "a"})
+	u.Store(2, User{Name: "b"})
+
+	s := u.BeginSnapshot()
+	u.Store(1, User{Name: "changed"})
+	u.Invalidate(2)
+	u.Store(3, User{})
+
+	if user, _ := s.Get(1); user.Name != "a" {
+		t.Errorf("snapshot sees %v for id 1", user)
+	}
+	if _, ok := s.Get(2); !ok {
+		t.Error("snapshot lost id 2")
+	}
+	if _, ok := s.Get(3); ok || s.Len() != 2 {
+		t.Errorf("snapshot sees a later write, Len %d", s.Len())
+	}
+	s.Close()
+	if _, ok := s.Get(1); ok {
+		t.Error("closed snapshot still answers")
+	}
+}
+
+func TestLogShardsFlushOnClose(t *testing.T) {
+	var out syncBuffer
+	u := &UserRepo{}
+	if err := u.Init(CacheConfig{LogShards: 4}, log.New(&out, "", 0)); err != nil {
+		t.Fatal(err)
+	}
+	for id := 0; id < 8; id++ {
+		u.Get(id)
+	}
+	if out.String() != "" {
+		t.Fatal("sharded lines reached the logger before Close")
+	}
+	u.Close()
+	if n := strings.Count(out.String(), notFoundInCache); n != 8 {
+		t.Fatalf("%d miss lines after Close, want 8", n)
+	}
+}
+
+// BenchmarkLogShards compares a contended Get on one shared logger with the
+// same Get on per-shard loggers.
+func BenchmarkLogShards(b *testing.B) {
+	for _, shards := range []int{0, 16} {
+		b.Run(fmt.Sprintf("Shards%d", shards), func(b *testing.B) {
+			u := &UserRepo{}
+			if err := u.Init(CacheConfig{LogShards: shards}, log.New(io.Discard, "", log.LstdFlags)); err != nil {
+				b.Fatal(err)
+			}
+			defer u.Close()
+			for id := 0; id < 1024; id++ {
+				u.Store(id, User{})
+			}
+			var next atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				id := int(next.Add(1))
+				for pb.Next() {
+					u.Get(id % 1024)
+					id += 17
+				}
+			})
+		})
+	}
+}
+
+func TestRetryBudgetSpansTheChain(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	var calls atomic.Int32
+	flaky := func(int) (User, bool, error) {
+		calls.Add(1)
+		return User{}, false, errors.New("flaky")
+	}
+	u.SetLoaderChain(flaky, flaky, flaky)
+
+	budget := RetryBudget{MaxAttempts: 5, MaxTime: time.Second, Backoff: time.Millisecond}
+	ctx := context.WithValue(context.Background(), RetryBudgetKey, budget)
+	start := time.Now()
+	u.GetCtx(ctx, 1)
+	if got := calls.Load(); got != 5 {
+		t.Errorf("%d loader calls across the chain, want 5", got)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("load took %v", d)
+	}
+
+	calls.Store(0)
+	budget = RetryBudget{MaxTime: 30 * time.Millisecond, Backoff: 5 * time.Millisecond}
+	ctx = context.WithValue(context.Background(), RetryBudgetKey, budget)
+	start = time.Now()
+	u.GetCtx(ctx, 2)
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("load ran %v past a 30ms MaxTime", d)
+	}
+}
+
+func TestTopKeysFindsHotIDs(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{TrackHotKeys: true})
+	for id := 0; id < 100; id++ {
+		u.Store(id, User{})
+		u.Get(id)
+	}
+	for i := 0; i < 50; i++ {
+		u.Get(7)
+		u.Get(42)
+		if i%2 == 0 {
+			u.Get(13)
+		}
+	}
+
+	top := u.TopKeys(3)
+	ids := make([]int, len(top))
+	for i, k := range top {
+		ids[i] = k.ID
+	}
+	if !slices.Equal(ids[2:], []int{13}) || !slices.Contains(ids[:2], 7) || !slices.Contains(ids[:2], 42) {
+		t.Fatalf("TopKeys(3) = %+v, want 7 and 42, then 13", top)
+	}
+	if newTestRepo(t, CacheConfig{}).TopKeys(3) != nil {
+		t.Fatal("TopKeys without TrackHotKeys returned keys")
+	}
+}
+
+func TestPressureLevels(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{Kind: CacheRWMutex, MaxEntries: 100, Overflow: OverflowReject})
+	if p := u.Pressure(); p != 0 {
+		t.Fatalf("empty cache pressure = %v", p)
+	}
+	for id := 0; id < 50; id++ {
+		u.Store(id, User{})
+	}
+	if p := u.Pressure(); p != 0.5 {
+		t.Fatalf("half full pressure = %v", p)
+	}
+	for id := 50; id < 100; id++ {
+		u.Store(id, User{})
+	}
+	if p := u.Pressure(); p != 1 {
+		t.Fatalf("full pressure = %v", p)
+	}
+
+	c := newTestRepo(t, CacheConfig{MaxCost: 10})
+	c.StoreWithCost(1, User{}, 4)
+	if p := c.Pressure(); p != 0.4 {
+		t.Fatalf("cost pressure = %v", p)
+	}
+	if p := newTestRepo(t, CacheConfig{}).Pressure(); p != 0 {
+		t.Fatalf("unbounded cache pressure = %v", p)
+	}
+}
+
+func TestReplayReproducesSession(t *testing.T) {
+	var trace bytes.Buffer
+	rec, err := CreateApp(CacheRWMutex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Close()
+	rec.UserS.Use(TraceMiddleware(&trace))
+	rec.UserS.Store(1, User{Name: "a b", Counter: 3})
+	rec.UserS.Get(1)
+	rec.UserS.Store(2, User{Name: `quoted "name"`})
+	rec.UserS.Get(3)
+	rec.UserS.Store(1, User{Name: "c"})
+	rec.UserS.Store(4, User{Name: "gone"})
+	rec.UserS.GetAndDelete(4)
+	if !strings.Contains(trace.String(), " delete 4\n") {
+		t.Fatalf("trace has no delete:\n%s", trace.String())
+	}
+
+	replay, err := CreateApp(CacheRWMutex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Close()
+	if err := Replay(&trace, &replay.UserS, false); err != nil {
+		t.Fatal(err)
+	}
+
+	want := maps.Collect(rec.UserS.service.repo.All())
+	if got := maps.Collect(replay.UserS.service.repo.All()); !maps.Equal(got, want) {
+		t.Fatalf("replayed cache = %v, want %v", got, want)
+	}
+	if n, want := replay.UserS.DBLen(), rec.UserS.DBLen(); n != want {
+		t.Fatalf("replayed db has %d users, want %d", n, want)
+	}
+	if err := Replay(strings.NewReader("0 delete 1\n"), &mapCache{}, false); err == nil {
+		t.Fatal("Replay ran a delete against a Cache without GetAndDelete")
+	}
+	if err := Replay(strings.NewReader("0 frob 1\n"), &replay.UserS, false); err == nil {
+		t.Fatal("Replay accepted an unknown op")
+	}
+}
+
+func TestAllYieldsEveryEntry(t *testing.T) {
+	u := newTestRepo(t, CacheConfig{})
+	want := map[int]User{1: {Name: "a"}, 2: {Name: "b"}, 3: {Name: "c"}}
+	for id, user := range want {
+		u.Store(id, user)
+	}
+	if got := maps.Collect(u.All()); !maps.Equal(got, want) {
+		t.Fatalf("All = %v, want %v", got, want)
+	}
+
+	n := 0
+	for range u.All() {
+		n++
+		if n == 2 {
+			break
+		}
+	}
+	if n != 2 {
+		t.Fatalf("iteration ran %d times after break", n)
+	}
+}
+
+func TestKeyedMutexSerializesPerID(t *testing.T) {
+	var k keyedMutex
+	const hold = 20 * time.Millisecond
+
+	run := func(ids ...int) time.Duration {
+		start := time.Now()
+		var wg sync.WaitGroup
+		for _, id := range ids {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				k.lock(id)
+				time.Sleep(hold)
+				k.unlock(id)
+			}()
+		}
+		wg.Wait()
+		return time.Since(start)
+	}
+
+	if d := run(1, 2, 3, 4); d >= 3*hold {
+		t.Errorf("different ids took %v, want them in parallel", d)
+	}
+	if d := run(5, 5, 5); d < 3*hold {
+		t.Errorf("same id took %v, want the holders one after another", d)
+	}
+	if n := k.len(); n != 0 {
+		t.Errorf("%d entries left after every unlock", n)
+	}
+}
+
+func TestDoManyLoadsEachIDOnce(t *testing.T) {
+	var g inflightGroup
+	g.init()
+	const batches = 10
+
+	var mu sync.Mutex
+	loads := make(map[int]int)
+	var entered atomic.Int32
+	release := make(chan struct{})
+	fn := func(ids []int) map[int]User {
+		mu.Lock()
+		for _, id := range ids {
+			loads[id]++
+		}
+		mu.Unlock()
+		entered.Add(1)
+		<-release
+		found := make(map[int]User)
+		for _, id := range ids {
+			found[id] = User{Counter: id}
+		}
+		return found
+	}
+
+	var wg sync.WaitGroup
+	for b := 0; b < batches; b++ {
+		// neighbouring batches overlap by half, and each has one id of its
+		// own so that every batch calls fn
+		ids := []int{1000 + b}
+		for id := b * 10; id < b*10+20; id++ {
+			ids = append(ids, id)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			found := g.doMany(ids, fn)
+			for _, id := range ids {
+				if found[id].Counter != id {
+					t.Errorf("batch %d got %v for id %d", b, found[id], id)
+				}
+			}
+		}()
+	}
+	for entered.Load() < batches {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	for id, n := range loads {
+		if n != 1 {
+			t.Errorf("id %d loaded %d times", id, n)
+		}
+	}
+	if n := g.len(); n != 0 {
+		t.Errorf("%d loads left in flight", n)
+	}
+}
+
+func TestEvictionCounters(t *testing.T) {
+	bound := newTestRepo(t, CacheConfig{Kind: CacheSyncMap, MaxEntries: 10})
+	for id := 0; id <= 10; id++ {
+		bound.Store(id, User{})
+	}
+	if s := bound.Stats(); s.BoundEvicted == 0 || s.CostEvicted != 0 {
+		t.Errorf("MaxEntries: BoundEvicted %d, CostEvicted %d", s.BoundEvicted, s.CostEvicted)
+	}
+
+	cost := newTestRepo(t, CacheConfig{MaxCost: 2})
+	for id := 0; id < 3; id++ {
+		cost.Store(id, User{})
+	}
+	if s := cost.Stats(); s.CostEvicted != 1 || s.BoundEvicted != 0 {
+		t.Errorf("MaxCost: CostEvicted %d, BoundEvicted %d, want 1 and 0", s.CostEvicted, s.BoundEvicted)
+	}
+
+	clock := newFakeClock()
+	idle := newTestRepo(t, CacheConfig{TTI: time.Minute})
+	idle.clock = clock.Now
+	idle.Store(1, User{})
+	clock.Advance(2 * time.Minute)
+	idle.Get(1)
+	if s := idle.Stats(); s.ExpiredMisses != 1 || s.BoundEvicted+s.CostEvicted != 0 {
+		t.Errorf("TTI: ExpiredMisses %d, evictions %d", s.ExpiredMisses, s.BoundEvicted+s.CostEvicted)
+	}
+
+	cost.ResetStats()
+	if s := cost.Stats(); s.CostEvicted != 0 {
+		t.Errorf("CostEvicted = %d after ResetStats", s.CostEvicted)
+	}
+}
+
+func TestPositiveIntFlag(t *testing.T) {
+	var p positiveInt
+	for _, bad := range []string{"0", "-8", "x"} {
+		if err := p.Set(bad); err == nil {
+			t.Errorf("Set(%q) accepted", bad)
+		}
+	}
+	if err := p.Set("3"); err != nil || p != 3 {
+		t.Fatalf("Set(\"3\") = %v, value %d", err, p)
+	}
+}
+
+func TestLockPreference(t *testing.T) {
+	// acquired reports whether RLock returns while a writer is waiting
+	acquired := func(p LockPreference) bool {
+		l := newRWLocker(p)
+		l.RLock()
+		writerDone := make(chan struct{})
+		go func() {
+			l.Lock()
+			l.Unlock()
+			close(writerDone)
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		got := make(chan struct{})
+		go func() {
+			l.RLock()
+			close(got)
+			l.RUnlock()
+		}()
+		select {
+		case <-got:
+			l.RUnlock()
+			<-writerDone
+			return true
+		case <-time.After(10 * time.Millisecond):
+			l.RUnlock()
+			<-writerDone
+			<-got
+			return false
+		}
+	}
+
+	for p, want := range map[LockPreference]bool{LockStd: false, LockPreferReaders: true, LockPreferWriters: false} {
+		if got := acquired(p); got != want {
+			t.Errorf("%s: new reader admitted past a waiting writer = %v, want %v", p, got, want)
+		}
+	}
+}
+
+func TestPrefRWMutexExcludesWriters(t *testing.T) {
+	for _, p := range []LockPreference{LockPreferReaders, LockPreferWriters} {
+		l := newRWLocker(p)
+		n := 0
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					if j%4 == 0 {
+						l.Lock()
+						n++
+						l.Unlock()
+					} else {
+						l.RLock()
+						_ = n
+						l.RUnlock()
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if n != 20*25 {
+			t.Errorf("%s: %d increments, want %d", p, n, 20*25)
+		}
+	}
+}
+
+// BenchmarkLockPreference runs a 90% read workload on the RWMutex backend
+// under each LockPreference and reports the mean read and write latency.
+func BenchmarkLockPreference(b *testing.B) {
+	for _, p := range []LockPreference{LockStd, LockPreferReaders, LockPreferWriters} {
+		b.Run(benchName(p.String()), func(b *testing.B) {
+			c := newCacheBackend(CacheConfig{Kind: CacheRWMutex, LockPreference: p}, nil, func(int) {})
+			for id := 0; id < 1024; id++ {
+				c.swap(id, User{})
+			}
+			var readNs, reads, writeNs, writes atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					start := time.Now()
+					if i%10 == 0 {
+						c.swap(i%1024, User{Counter: i})
+						writeNs.Add(int64(time.Since(start)))
+						writes.Add(1)
+					} else {
+						c.load(i % 1024)
+						readNs.Add(int64(time.Since(start)))
+						reads.Add(1)
+					}
+				}
+			})
+			if reads.Load() > 0 {
+				b.ReportMetric(float64(readNs.Load())/float64(reads.Load()), "read-ns/op")
+			}
+			if writes.Load() > 0 {
+				b.ReportMetric(float64(writeNs.Load())/float64(writes.Load()), "write-ns/op")
+			}
+		})
+	}
+}
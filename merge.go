@@ -0,0 +1,95 @@
+package main
+
+// ConflictPolicy picks the winner when Merge imports an id both repos have.
+type ConflictPolicy int
+
+const (
+	KeepMine ConflictPolicy = iota
+	TakeTheirs
+	// HighestVersion takes the entry whose db version, counted as by
+	// Gossip, is higher, keeping this repo's on a tie.
+	HighestVersion
+)
+
+func (p ConflictPolicy) String() string {
+	switch p {
+	case KeepMine:
+		return "keep mine"
+	case TakeTheirs:
+		return "take theirs"
+	case HighestVersion:
+		return "highest version"
+	}
+	return "unknown"
+}
+
+// Merge imports other's cached entries into this repo's db and cache,
+// resolving ids this repo already has with conflict, and returns how many
+// entries it took. Entries that other has only in its db are not imported.
+// An entry taken under HighestVersion keeps its version. With CacheOnly there
+// are no versions and HighestVersion acts as KeepMine. Taken entries are
+// mirrored like any other write.
+func (u *UserRepo) Merge(other *UserRepo, conflict ConflictPolicy) (int, error) {
+	u.writes.Add(1)
+	defer u.writes.Add(-1)
+	if u.draining.Load() {
+		return 0, ErrDraining
+	}
+	if !u.ready.Load() {
+		return 0, ErrNotInitialized
+	}
+	if !other.ready.Load() {
+		return 0, nil
+	}
+
+	theirs := other.backend().snapshot()
+	versions := make(map[int]uint64, len(theirs))
+	other.dbMutex.Lock()
+	for id := range theirs {
+		versions[id] = other.versions[id].version
+	}
+	other.dbMutex.Unlock()
+
+	taken := make(map[int]User)
+	if u.cfg.CacheOnly {
+		c := u.backend()
+		for id, user := range theirs {
+			if _, mine := c.load(id); !mine || conflict == TakeTheirs {
+				if u.cfg.InvalidateDebounce > 0 {
+					u.refreshes.cancel(id)
+				}
+				taken[id] = user
+			}
+		}
+	} else {
+		u.dbMutex.Lock()
+		for id, user := range theirs {
+			_, mine := u.db[id]
+			switch {
+			case !mine, conflict == TakeTheirs:
+			case conflict == HighestVersion && versions[id] > u.versions[id].version:
+			default:
+				continue
+			}
+
+			if u.cfg.InvalidateDebounce > 0 {
+				u.refreshes.cancel(id)
+			}
+			u.putDB(id, user)
+			if conflict == HighestVersion {
+				u.seq++
+				u.versions[id] = entryVersion{version: versions[id], seq: u.seq}
+			} else {
+				u.bumpVersion(id)
+			}
+			taken[id] = user
+		}
+		u.dbMutex.Unlock()
+	}
+
+	for id, user := range taken {
+		u.storeInCache(id, user)
+		u.mirror(id, user)
+	}
+	return len(taken), nil
+}
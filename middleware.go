@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+type OpKind int
+
+const (
+	OpGet OpKind = iota
+	OpStore
+	OpDelete
+)
+
+func (k OpKind) String() string {
+	switch k {
+	case OpGet:
+		return "get"
+	case OpStore:
+		return "store"
+	case OpDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+type Op struct {
+	Kind OpKind
+	ID   int
+	User User
+}
+
+// OpFunc handles a Get, Store or GetAndDelete. For OpGet and OpDelete the
+// result is the user and whether it was found; for OpStore only the error is
+// meaningful.
+type OpFunc func(op Op) (User, bool, error)
+
+type Middleware func(next OpFunc) OpFunc
+
+func TimingMiddleware(logger *log.Logger) Middleware {
+	return func(next OpFunc) OpFunc {
+		return func(op Op) (User, bool, error) {
+			start := time.Now()
+			user, ok, err := next(op)
+			logger.Printf("%s %d took %v", op.Kind, op.ID, time.Since(start))
+			return user, ok, err
+		}
+	}
+}
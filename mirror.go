@@ -0,0 +1,27 @@
+package main
+
+type mirrorRef struct {
+	Cache
+}
+
+// MirrorTo copies every later write to secondary as well, e.g. while
+// migrating to it; reads keep coming from this repo only. A failed mirror
+// write is logged and does not fail the write here. Deletes are not mirrored
+// since Cache has no delete. A nil secondary stops mirroring.
+func (u *UserRepo) MirrorTo(secondary Cache) {
+	if secondary == nil {
+		u.mirrorTo.Store(nil)
+		return
+	}
+	u.mirrorTo.Store(&mirrorRef{secondary})
+}
+
+func (u *UserRepo) mirror(id int, user User) {
+	m := u.mirrorTo.Load()
+	if m == nil {
+		return
+	}
+	if err := m.Store(id, user); err != nil {
+		u.logFor(id).Println(mirrorFailed, id, err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// OverflowPolicy decides what a Store of a new id does once the cache holds
+// MaxEntries entries.
+type OverflowPolicy int
+
+const (
+	// OverflowEvict lets the sync.Map backend evict to make room. The other
+	// backends cannot evict, so Init rejects MaxEntries with it for them.
+	OverflowEvict OverflowPolicy = iota
+	// OverflowReject fails the Store with ErrFull.
+	OverflowReject
+	// OverflowBlock makes the Store wait until an entry is removed or its
+	// context is done.
+	OverflowBlock
+)
+
+const overflowPollInterval = time.Millisecond
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowEvict:
+		return "evict"
+	case OverflowReject:
+		return "reject"
+	case OverflowBlock:
+		return "block"
+	}
+	return "unknown"
+}
+
+// full reports whether caching id would take the cache over MaxEntries under
+// OverflowReject or OverflowBlock. Overwriting a cached id never does, though
+// the CacheSnapshot backend only sees ids once they have been published.
+func (u *UserRepo) full(id int) bool {
+	max := u.maxEntries.Load()
+	if max == 0 {
+		return false
+	}
+	c := u.backend()
+	if int64(c.len()) < max {
+		return false
+	}
+	_, ok := c.load(id)
+	return !ok
+}
+
+// waitForRoom applies the overflow policy before a Store of id. The check and
+// the store are not atomic, so concurrent Stores can overshoot MaxEntries by
+// a few entries.
+func (u *UserRepo) waitForRoom(ctx context.Context, id int) error {
+	if !u.full(id) {
+		return nil
+	}
+	if u.cfg.Overflow == OverflowReject {
+		return ErrFull
+	}
+
+	t := time.NewTicker(overflowPollInterval)
+	defer t.Stop()
+	for u.full(id) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// pinSet holds the ids that eviction must skip. The count lets the common
+// case of no pins avoid the map lookup.
+type pinSet struct {
+	m sync.Map
+	n atomic.Int64
+}
+
+func (p *pinSet) pin(id int) {
+	if _, loaded := p.m.LoadOrStore(id, struct{}{}); !loaded {
+		p.n.Add(1)
+	}
+}
+
+func (p *pinSet) unpin(id int) {
+	if _, loaded := p.m.LoadAndDelete(id); loaded {
+		p.n.Add(-1)
+	}
+}
+
+func (p *pinSet) has(id int) bool {
+	if p == nil || p.n.Load() == 0 {
+		return false
+	}
+	_, ok := p.m.Load(id)
+	return ok
+}
+
+// Pin exempts id from eviction by MaxEntries and MaxCost. A pinned entry is
+// still counted in Stats, Cost and HealthCheck, and it can still be replaced
+// or removed explicitly.
+func (u *UserRepo) Pin(id int) {
+	u.pins.pin(id)
+}
+
+func (u *UserRepo) Unpin(id int) {
+	u.pins.unpin(id)
+}
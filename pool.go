@@ -0,0 +1,43 @@
+package main
+
+// asyncPool bounds the goroutines UserRepo starts for background work. A nil
+// slots channel means unbounded.
+type asyncPool struct {
+	slots chan struct{}
+}
+
+func (p *asyncPool) init(size int) {
+	if size > 0 {
+		p.slots = make(chan struct{}, size)
+	}
+}
+
+// try runs fn in a new goroutine if the pool has room and reports whether it
+// did; it never waits for room.
+func (p *asyncPool) try(fn func()) bool {
+	if p.slots == nil {
+		go fn()
+		return true
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		return false
+	}
+	go func() {
+		defer func() { <-p.slots }()
+		fn()
+	}()
+	return true
+}
+
+// spawn is try for the repo's async work, counting tasks the pool had no
+// room for.
+func (u *UserRepo) spawn(fn func()) bool {
+	if u.async.try(fn) {
+		return true
+	}
+	u.stats.asyncRejected.Add(1)
+	return false
+}
@@ -0,0 +1,32 @@
+package main
+
+// Snapshot is a point-in-time copy of the cache for reading many ids
+// consistently; later writes to the repo do not show through it. It is safe
+// for concurrent use until Close.
+type Snapshot struct {
+	users map[int]User
+}
+
+// BeginSnapshot copies the cached entries, which is O(n) in the cache size.
+// Ids that are not cached, even if the db has them, are missing from the
+// snapshot.
+func (u *UserRepo) BeginSnapshot() *Snapshot {
+	if !u.ready.Load() {
+		return &Snapshot{}
+	}
+	return &Snapshot{users: u.backend().snapshot()}
+}
+
+func (s *Snapshot) Get(id int) (User, bool) {
+	user, ok := s.users[id]
+	return user, ok
+}
+
+func (s *Snapshot) Len() int {
+	return len(s.users)
+}
+
+// Close releases the copy. Get on a closed Snapshot reports a miss.
+func (s *Snapshot) Close() {
+	s.users = nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import "sync"
+
+// LockPreference picks the read/write lock behind the CacheRWMutex backend.
+type LockPreference int
+
+const (
+	// LockStd uses sync.RWMutex, which stops admitting new readers once a
+	// writer is waiting.
+	LockStd LockPreference = iota
+	// LockPreferReaders admits readers whenever no writer holds the lock, so
+	// a steady stream of readers can starve writers.
+	LockPreferReaders
+	// LockPreferWriters admits no new readers while a writer is waiting, so a
+	// steady stream of writers can starve readers.
+	LockPreferWriters
+)
+
+func (p LockPreference) String() string {
+	switch p {
+	case LockStd:
+		return "std"
+	case LockPreferReaders:
+		return "prefer readers"
+	case LockPreferWriters:
+		return "prefer writers"
+	}
+	return "unknown"
+}
+
+type rwLocker interface {
+	Lock()
+	Unlock()
+	RLock()
+	RUnlock()
+}
+
+func newRWLocker(p LockPreference) rwLocker {
+	if p == LockStd {
+		return &sync.RWMutex{}
+	}
+	l := &prefRWMutex{preferWriters: p == LockPreferWriters}
+	l.cond.L = &l.mu
+	return l
+}
+
+// prefRWMutex is a read/write lock built on a mutex and a condition variable,
+// trading sync.RWMutex's speed for a configurable preference. Every release
+// wakes all waiters, which is simple but costly under heavy contention.
+type prefRWMutex struct {
+	mu             sync.Mutex
+	cond           sync.Cond
+	readers        int
+	writer         bool
+	waitingWriters int
+	preferWriters  bool
+}
+
+func (l *prefRWMutex) RLock() {
+	l.mu.Lock()
+	for l.writer || (l.preferWriters && l.waitingWriters > 0) {
+		l.cond.Wait()
+	}
+	l.readers++
+	l.mu.Unlock()
+}
+
+func (l *prefRWMutex) RUnlock() {
+	l.mu.Lock()
+	l.readers--
+	if l.readers == 0 {
+		l.cond.Broadcast()
+	}
+	l.mu.Unlock()
+}
+
+func (l *prefRWMutex) Lock() {
+	l.mu.Lock()
+	l.waitingWriters++
+	for l.writer || l.readers > 0 {
+		l.cond.Wait()
+	}
+	l.waitingWriters--
+	l.writer = true
+	l.mu.Unlock()
+}
+
+func (l *prefRWMutex) Unlock() {
+	l.mu.Lock()
+	l.writer = false
+	l.cond.Broadcast()
+	l.mu.Unlock()
+}
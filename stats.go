@@ -0,0 +1,135 @@
+package main
+
+import "sync/atomic"
+
+// MissReason says why a lookup was not answered by the cache.
+type MissReason int
+
+const (
+	MissNone MissReason = iota
+	// MissCold means the id was not cached.
+	MissCold
+	// MissExpired means the entry was cached but idle longer than TTI.
+	MissExpired
+	// MissNotInDB means the cache missed and the load found no user either.
+	MissNotInDB
+)
+
+func (r MissReason) String() string {
+	switch r {
+	case MissNone:
+		return "none"
+	case MissCold:
+		return "cold"
+	case MissExpired:
+		return "expired"
+	case MissNotInDB:
+		return "not in db"
+	}
+	return "unknown"
+}
+
+type GetMetadata struct {
+	Found    bool
+	CacheHit bool
+	// MissReason is MissNone on a cache hit.
+	MissReason MissReason
+}
+
+type Stats struct {
+	Hits             uint64
+	Misses           uint64
+	DBHits           uint64
+	DBMisses         uint64
+	Discrepancies    uint64
+	OversizedSkipped uint64
+	L2Hits           uint64
+	L2Misses         uint64
+	GCEvicted        uint64
+	// ColdMisses and ExpiredMisses split Misses by MissReason; a load that
+	// then misses the db as well is counted in DBMisses.
+	ColdMisses    uint64
+	ExpiredMisses uint64
+	// DBEvicted counts users dropped to keep the db within MaxDBEntries.
+	DBEvicted uint64
+	// BoundEvicted counts entries the sync.Map backend evicted to stay within
+	// MaxEntries, CostEvicted those evicted to stay within MaxCost and
+	// GCEvicted those shed under memory pressure. TTI expiries are counted in
+	// ExpiredMisses, as each one is found by the read that misses on it.
+	BoundEvicted uint64
+	CostEvicted  uint64
+	// AsyncRejected counts background tasks AsyncWorkers had no room for.
+	AsyncRejected uint64
+	// Lifetimes counts entry lifetimes per LifetimeBuckets bucket when
+	// TrackLifetimes is set.
+	Lifetimes LifetimeHistogram
+	// LastMinute and Last5Minutes are filled in when TrackHitWindows is set.
+	LastMinute   WindowCounts
+	Last5Minutes WindowCounts
+}
+
+func (s Stats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+type repoStats struct {
+	hits             atomic.Uint64
+	misses           atomic.Uint64
+	dbHits           atomic.Uint64
+	dbMisses         atomic.Uint64
+	discrepancies    atomic.Uint64
+	oversizedSkipped atomic.Uint64
+	l2Hits           atomic.Uint64
+	l2Misses         atomic.Uint64
+	gcEvicted        atomic.Uint64
+	coldMisses       atomic.Uint64
+	expiredMisses    atomic.Uint64
+	dbEvicted        atomic.Uint64
+	asyncRejected    atomic.Uint64
+	boundEvicted     atomic.Uint64
+	costEvicted      atomic.Uint64
+}
+
+func (s *repoStats) countMiss(reason MissReason) {
+	switch reason {
+	case MissCold:
+		s.coldMisses.Add(1)
+	case MissExpired:
+		s.expiredMisses.Add(1)
+	}
+}
+
+// reset zeroes the counters one by one, so operations running concurrently
+// may be counted in some of them and not others.
+func (s *repoStats) reset() {
+	for _, c := range []*atomic.Uint64{
+		&s.hits, &s.misses, &s.dbHits, &s.dbMisses, &s.discrepancies, &s.oversizedSkipped,
+		&s.l2Hits, &s.l2Misses, &s.gcEvicted, &s.coldMisses, &s.expiredMisses, &s.dbEvicted, &s.asyncRejected,
+		&s.boundEvicted, &s.costEvicted,
+	} {
+		c.Store(0)
+	}
+}
+
+func (s *repoStats) snapshot() Stats {
+	return Stats{
+		Hits:             s.hits.Load(),
+		Misses:           s.misses.Load(),
+		DBHits:           s.dbHits.Load(),
+		DBMisses:         s.dbMisses.Load(),
+		Discrepancies:    s.discrepancies.Load(),
+		OversizedSkipped: s.oversizedSkipped.Load(),
+		L2Hits:           s.l2Hits.Load(),
+		L2Misses:         s.l2Misses.Load(),
+		GCEvicted:        s.gcEvicted.Load(),
+		ColdMisses:       s.coldMisses.Load(),
+		ExpiredMisses:    s.expiredMisses.Load(),
+		DBEvicted:        s.dbEvicted.Load(),
+		AsyncRejected:    s.asyncRejected.Load(),
+		BoundEvicted:     s.boundEvicted.Load(),
+		CostEvicted:      s.costEvicted.Load(),
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceMiddleware records every Get, Store and GetAndDelete to w, one line per
+// operation in the order they started:
+//
+//	<ns since the first op> get <id>
+//	<ns since the first op> store <id> <counter> <quoted name>
+//	<ns since the first op> delete <id>
+//
+// Write errors are ignored.
+func TraceMiddleware(w io.Writer) Middleware {
+	var mu sync.Mutex
+	var start time.Time
+	return func(next OpFunc) OpFunc {
+		return func(op Op) (User, bool, error) {
+			mu.Lock()
+			if start.IsZero() {
+				start = time.Now()
+			}
+			at := time.Since(start).Nanoseconds()
+			if op.Kind == OpStore {
+				fmt.Fprintf(w, "%d %s %d %d %s\n", at, op.Kind, op.ID, op.User.Counter, strconv.Quote(op.User.Name))
+			} else {
+				fmt.Fprintf(w, "%d %s %d\n", at, op.Kind, op.ID)
+			}
+			mu.Unlock()
+
+			return next(op)
+		}
+	}
+}
+
+// deleter is implemented by the caches Replay can run delete ops against,
+// such as UserServer.
+type deleter interface {
+	GetAndDelete(id int) (User, bool, error)
+}
+
+// Replay runs the operations of a trace written by TraceMiddleware against c,
+// one after another. With timed it keeps the recorded spacing between them,
+// otherwise it runs them back to back. A trace with deletes needs a c that has
+// GetAndDelete.
+func Replay(trace io.Reader, c Cache, timed bool) error {
+	sc := bufio.NewScanner(trace)
+	start := time.Now()
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.SplitN(sc.Text(), " ", 5)
+		if len(fields) < 3 {
+			return fmt.Errorf("line %d: too few fields", line)
+		}
+		at, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("line %d: bad offset %q", line, fields[0])
+		}
+		id, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return fmt.Errorf("line %d: bad id %q", line, fields[2])
+		}
+		if timed {
+			time.Sleep(time.Until(start.Add(time.Duration(at))))
+		}
+
+		switch fields[1] {
+		case OpGet.String():
+			c.Get(id)
+		case OpStore.String():
+			if len(fields) != 5 {
+				return fmt.Errorf("line %d: store needs counter and name", line)
+			}
+			counter, err := strconv.Atoi(fields[3])
+			if err != nil {
+				return fmt.Errorf("line %d: bad counter %q", line, fields[3])
+			}
+			name, err := strconv.Unquote(fields[4])
+			if err != nil {
+				return fmt.Errorf("line %d: bad name %s", line, fields[4])
+			}
+			if err := c.Store(id, User{Name: name, Counter: counter}); err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+		case OpDelete.String():
+			d, ok := c.(deleter)
+			if !ok {
+				return fmt.Errorf("line %d: %T cannot delete", line, c)
+			}
+			if _, _, err := d.GetAndDelete(id); err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+		default:
+			return fmt.Errorf("line %d: unknown op %q", line, fields[1])
+		}
+	}
+	return sc.Err()
+}
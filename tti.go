@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// idleTracker keeps the last access time of each cached entry for TTI
+// expiry, and for Resize to find the least recently used entries. Expiry is
+// checked lazily when an entry is read; an idle entry that is never read
+// again stays in memory until it is overwritten or removed.
+type idleTracker struct {
+	last sync.Map
+}
+
+func (t *idleTracker) touch(id int, now time.Time) {
+	if v, ok := t.last.Load(id); ok {
+		v.(*atomic.Int64).Store(now.UnixNano())
+		return
+	}
+	v := &atomic.Int64{}
+	v.Store(now.UnixNano())
+	t.last.Store(id, v)
+}
+
+// expired reports whether id has been idle for longer than tti and otherwise
+// records the access. An entry with no recorded access counts as fresh.
+func (t *idleTracker) expired(id int, now time.Time, tti time.Duration) bool {
+	v, ok := t.last.Load(id)
+	if !ok {
+		t.touch(id, now)
+		return false
+	}
+	last := v.(*atomic.Int64)
+	if now.UnixNano()-last.Load() > int64(tti) {
+		return true
+	}
+	last.Store(now.UnixNano())
+	return false
+}
+
+func (t *idleTracker) forget(id int) {
+	t.last.Delete(id)
+}
+
+// lastUse returns the last access of id in Unix nanoseconds, or zero if none
+// is recorded.
+func (t *idleTracker) lastUse(id int) int64 {
+	v, ok := t.last.Load(id)
+	if !ok {
+		return 0
+	}
+	return v.(*atomic.Int64).Load()
+}
@@ -0,0 +1,134 @@
+package main
+
+// Tx buffers the reads and writes of one Transaction. It must not be used
+// after the closure passed to Transaction returns.
+type Tx struct {
+	u *UserRepo
+	// writes holds the buffered value per id; nil marks a delete.
+	writes map[int]*User
+}
+
+// Get returns id as the transaction currently sees it: its own buffered
+// writes first, then the db.
+func (tx *Tx) Get(id int) (User, bool) {
+	if user, ok := tx.writes[id]; ok {
+		if user == nil {
+			return User{}, false
+		}
+		return *user, true
+	}
+
+	u := tx.u
+	if w, ok := u.coalescer.pending[id]; ok {
+		return w.user, true
+	}
+	if u.cfg.CacheOnly {
+		return u.backend().load(id)
+	}
+	user, ok := u.db[id]
+	return user, ok
+}
+
+func (tx *Tx) Store(id int, user User) {
+	tx.writes[id] = &user
+}
+
+func (tx *Tx) Delete(id int) {
+	tx.writes[id] = nil
+}
+
+// Transaction runs fn and, if it returns nil, applies all of its writes to the
+// db and the cache; if it returns an error nothing is applied. A transaction
+// whose new ids could only fit within MaxDBEntries by evicting ids it writes
+// itself fails with ErrFull. For simplicity
+// the whole transaction runs under the db lock, so it is serialized with every
+// other write and db load. Cache readers do not take that lock and may see the
+// writes land one id at a time.
+func (u *UserRepo) Transaction(fn func(tx *Tx) error) error {
+	u.writes.Add(1)
+	defer u.writes.Add(-1)
+	if u.draining.Load() {
+		return ErrDraining
+	}
+	if !u.ready.Load() {
+		return ErrNotInitialized
+	}
+
+	// coalescer.mu is taken before dbMutex, as flushPending does, so no
+	// buffered Store can be flushed over the transaction's writes
+	if u.cfg.WriteCoalesceWindow > 0 {
+		u.coalescer.mu.Lock()
+		defer u.coalescer.mu.Unlock()
+	}
+	u.dbMutex.Lock()
+	defer u.dbMutex.Unlock()
+
+	tx := &Tx{u: u, writes: make(map[int]*User)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if !tx.fits() {
+		return ErrFull
+	}
+
+	// deletes go first so the room they free is used before MaxDBEntries
+	// evicts anything
+	for id, user := range tx.writes {
+		if user != nil {
+			continue
+		}
+		tx.cancelPending(id)
+		if !u.cfg.CacheOnly {
+			delete(u.db, id)
+			delete(u.versions, id)
+			u.seq++
+		}
+		u.removeFromCache(id)
+	}
+	for id, user := range tx.writes {
+		if user == nil {
+			continue
+		}
+		tx.cancelPending(id)
+		if !u.cfg.CacheOnly {
+			u.putDBKeeping(id, *user, tx.writes)
+			u.bumpVersion(id)
+		}
+		u.storeInCacheWithCost(id, *user, 1)
+		u.mirror(id, *user)
+	}
+
+	return nil
+}
+
+func (tx *Tx) cancelPending(id int) {
+	delete(tx.u.coalescer.pending, id)
+	if tx.u.cfg.InvalidateDebounce > 0 {
+		tx.u.refreshes.cancel(id)
+	}
+}
+
+// fits reports whether the db can take the writes within MaxDBEntries by
+// evicting only ids the transaction does not write.
+func (tx *Tx) fits() bool {
+	u := tx.u
+	max := u.cfg.MaxDBEntries
+	if max == 0 || u.cfg.CacheOnly {
+		return true
+	}
+
+	size, touched := len(u.db), 0
+	for id, user := range tx.writes {
+		_, inDB := u.db[id]
+		if inDB {
+			touched++
+		}
+		switch {
+		case user == nil && inDB:
+			size--
+		case user != nil && !inDB:
+			size++
+		}
+	}
+	return size-max <= len(u.db)-touched
+}